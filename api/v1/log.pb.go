@@ -21,10 +21,117 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// Control tells data records from the markers written when a transaction ends.
+type Control int32
+
+const (
+	Control_CONTROL_NONE   Control = 0
+	Control_CONTROL_COMMIT Control = 1
+	Control_CONTROL_ABORT  Control = 2
+)
+
+// Enum value maps for Control.
+var (
+	Control_name = map[int32]string{
+		0: "CONTROL_NONE",
+		1: "CONTROL_COMMIT",
+		2: "CONTROL_ABORT",
+	}
+	Control_value = map[string]int32{
+		"CONTROL_NONE":   0,
+		"CONTROL_COMMIT": 1,
+		"CONTROL_ABORT":  2,
+	}
+)
+
+func (x Control) Enum() *Control {
+	p := new(Control)
+	*p = x
+	return p
+}
+
+func (x Control) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Control) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[0].Descriptor()
+}
+
+func (Control) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[0]
+}
+
+func (x Control) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Control.Descriptor instead.
+func (Control) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{0}
+}
+
+// IsolationLevel tells which records of transactions a consumer sees.
+type IsolationLevel int32
+
+const (
+	// READ_UNCOMMITTED sees all records, including those of open and aborted transactions.
+	IsolationLevel_READ_UNCOMMITTED IsolationLevel = 0
+	// READ_COMMITTED only sees records of committed transactions, and stops before the first record of an open one.
+	IsolationLevel_READ_COMMITTED IsolationLevel = 1
+)
+
+// Enum value maps for IsolationLevel.
+var (
+	IsolationLevel_name = map[int32]string{
+		0: "READ_UNCOMMITTED",
+		1: "READ_COMMITTED",
+	}
+	IsolationLevel_value = map[string]int32{
+		"READ_UNCOMMITTED": 0,
+		"READ_COMMITTED":   1,
+	}
+)
+
+func (x IsolationLevel) Enum() *IsolationLevel {
+	p := new(IsolationLevel)
+	*p = x
+	return p
+}
+
+func (x IsolationLevel) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (IsolationLevel) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_v1_log_proto_enumTypes[1].Descriptor()
+}
+
+func (IsolationLevel) Type() protoreflect.EnumType {
+	return &file_api_v1_log_proto_enumTypes[1]
+}
+
+func (x IsolationLevel) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use IsolationLevel.Descriptor instead.
+func (IsolationLevel) EnumDescriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{1}
+}
+
 type Record struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Value         []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
-	Offset        uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Value  []byte                 `protobuf:"bytes,1,opt,name=value,proto3" json:"value,omitempty"`
+	Offset uint64                 `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	// producer_id identifies the producer that appended the record, 0 if it did not ask for deduplication.
+	ProducerId uint64 `protobuf:"varint,3,opt,name=producer_id,json=producerId,proto3" json:"producer_id,omitempty"`
+	// sequence is the sequence number of the record among the records of its producer.
+	Sequence uint64 `protobuf:"varint,4,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// transaction_id is the id of the transaction the record was appended in, 0 outside of transactions.
+	TransactionId uint64 `protobuf:"varint,5,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	// control marks the commit and abort markers of transactions, which carry no value.
+	Control       Control `protobuf:"varint,6,opt,name=control,proto3,enum=log.v1.Control" json:"control,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -73,9 +180,48 @@ func (x *Record) GetOffset() uint64 {
 	return 0
 }
 
+func (x *Record) GetProducerId() uint64 {
+	if x != nil {
+		return x.ProducerId
+	}
+	return 0
+}
+
+func (x *Record) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *Record) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+func (x *Record) GetControl() Control {
+	if x != nil {
+		return x.Control
+	}
+	return Control_CONTROL_NONE
+}
+
 type ProduceRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Record        *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Record *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
+	// expected_offset makes the append conditional: the record is only appended if it gets this offset, i.e. if the log
+	// still ends there. Otherwise, the request fails with ABORTED.
+	ExpectedOffset *uint64 `protobuf:"varint,2,opt,name=expected_offset,json=expectedOffset,proto3,oneof" json:"expected_offset,omitempty"`
+	// producer_id makes the append idempotent: a producer numbers its records with increasing sequence numbers, and a
+	// retried record whose sequence number was appended already is not appended again, the response holds the offset it
+	// was appended at. 0 disables deduplication.
+	ProducerId uint64 `protobuf:"varint,3,opt,name=producer_id,json=producerId,proto3" json:"producer_id,omitempty"`
+	// sequence is the sequence number of the record among the records of its producer.
+	Sequence uint64 `protobuf:"varint,4,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// transaction_id appends the record in a transaction started with BeginTransaction, 0 appends it right away.
+	TransactionId uint64 `protobuf:"varint,5,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -117,6 +263,34 @@ func (x *ProduceRequest) GetRecord() *Record {
 	return nil
 }
 
+func (x *ProduceRequest) GetExpectedOffset() uint64 {
+	if x != nil && x.ExpectedOffset != nil {
+		return *x.ExpectedOffset
+	}
+	return 0
+}
+
+func (x *ProduceRequest) GetProducerId() uint64 {
+	if x != nil {
+		return x.ProducerId
+	}
+	return 0
+}
+
+func (x *ProduceRequest) GetSequence() uint64 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *ProduceRequest) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
 type ProduceResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
@@ -162,10 +336,13 @@ func (x *ProduceResponse) GetOffset() uint64 {
 }
 
 type ConsumeRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Offset        uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	Offset uint64                 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	// isolation_level tells which records the consumer sees. Transaction markers are never returned: Consume fails with
+	// NOT_FOUND on a record the consumer does not see, and ConsumeStream skips it.
+	IsolationLevel IsolationLevel `protobuf:"varint,2,opt,name=isolation_level,json=isolationLevel,proto3,enum=log.v1.IsolationLevel" json:"isolation_level,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *ConsumeRequest) Reset() {
@@ -205,6 +382,13 @@ func (x *ConsumeRequest) GetOffset() uint64 {
 	return 0
 }
 
+func (x *ConsumeRequest) GetIsolationLevel() IsolationLevel {
+	if x != nil {
+		return x.IsolationLevel
+	}
+	return IsolationLevel_READ_UNCOMMITTED
+}
+
 type ConsumeResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	Record        *Record                `protobuf:"bytes,1,opt,name=record,proto3" json:"record,omitempty"`
@@ -249,25 +433,352 @@ func (x *ConsumeResponse) GetRecord() *Record {
 	return nil
 }
 
+type FetchRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// offset is the offset of the first record to fetch.
+	Offset uint64 `protobuf:"varint,1,opt,name=offset,proto3" json:"offset,omitempty"`
+	// max_records limits the number of records in the response, 0 means the server's default.
+	MaxRecords uint32 `protobuf:"varint,2,opt,name=max_records,json=maxRecords,proto3" json:"max_records,omitempty"`
+	// max_bytes limits the encoded size of the records in the response, 0 means the server's default. The first record
+	// is returned even if it is larger, so that consumers make progress.
+	MaxBytes uint64 `protobuf:"varint,3,opt,name=max_bytes,json=maxBytes,proto3" json:"max_bytes,omitempty"`
+	// isolation_level tells which records the consumer sees, the others are skipped. Read-committed fetches stop at the
+	// last stable offset.
+	IsolationLevel IsolationLevel `protobuf:"varint,4,opt,name=isolation_level,json=isolationLevel,proto3,enum=log.v1.IsolationLevel" json:"isolation_level,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *FetchRequest) Reset() {
+	*x = FetchRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchRequest) ProtoMessage() {}
+
+func (x *FetchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchRequest.ProtoReflect.Descriptor instead.
+func (*FetchRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *FetchRequest) GetOffset() uint64 {
+	if x != nil {
+		return x.Offset
+	}
+	return 0
+}
+
+func (x *FetchRequest) GetMaxRecords() uint32 {
+	if x != nil {
+		return x.MaxRecords
+	}
+	return 0
+}
+
+func (x *FetchRequest) GetMaxBytes() uint64 {
+	if x != nil {
+		return x.MaxBytes
+	}
+	return 0
+}
+
+func (x *FetchRequest) GetIsolationLevel() IsolationLevel {
+	if x != nil {
+		return x.IsolationLevel
+	}
+	return IsolationLevel_READ_UNCOMMITTED
+}
+
+type FetchResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// records are the contiguous records from the requested offset on, empty at the end of the log.
+	Records []*Record `protobuf:"bytes,1,rep,name=records,proto3" json:"records,omitempty"`
+	// next_offset is the offset to request in the next fetch.
+	NextOffset    uint64 `protobuf:"varint,2,opt,name=next_offset,json=nextOffset,proto3" json:"next_offset,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FetchResponse) Reset() {
+	*x = FetchResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchResponse) ProtoMessage() {}
+
+func (x *FetchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchResponse.ProtoReflect.Descriptor instead.
+func (*FetchResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *FetchResponse) GetRecords() []*Record {
+	if x != nil {
+		return x.Records
+	}
+	return nil
+}
+
+func (x *FetchResponse) GetNextOffset() uint64 {
+	if x != nil {
+		return x.NextOffset
+	}
+	return 0
+}
+
+type BeginTransactionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BeginTransactionRequest) Reset() {
+	*x = BeginTransactionRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BeginTransactionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BeginTransactionRequest) ProtoMessage() {}
+
+func (x *BeginTransactionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BeginTransactionRequest.ProtoReflect.Descriptor instead.
+func (*BeginTransactionRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{7}
+}
+
+type BeginTransactionResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TransactionId uint64                 `protobuf:"varint,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BeginTransactionResponse) Reset() {
+	*x = BeginTransactionResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BeginTransactionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BeginTransactionResponse) ProtoMessage() {}
+
+func (x *BeginTransactionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BeginTransactionResponse.ProtoReflect.Descriptor instead.
+func (*BeginTransactionResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *BeginTransactionResponse) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+type EndTransactionRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	TransactionId uint64                 `protobuf:"varint,1,opt,name=transaction_id,json=transactionId,proto3" json:"transaction_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EndTransactionRequest) Reset() {
+	*x = EndTransactionRequest{}
+	mi := &file_api_v1_log_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EndTransactionRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndTransactionRequest) ProtoMessage() {}
+
+func (x *EndTransactionRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndTransactionRequest.ProtoReflect.Descriptor instead.
+func (*EndTransactionRequest) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *EndTransactionRequest) GetTransactionId() uint64 {
+	if x != nil {
+		return x.TransactionId
+	}
+	return 0
+}
+
+type EndTransactionResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *EndTransactionResponse) Reset() {
+	*x = EndTransactionResponse{}
+	mi := &file_api_v1_log_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *EndTransactionResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EndTransactionResponse) ProtoMessage() {}
+
+func (x *EndTransactionResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_v1_log_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EndTransactionResponse.ProtoReflect.Descriptor instead.
+func (*EndTransactionResponse) Descriptor() ([]byte, []int) {
+	return file_api_v1_log_proto_rawDescGZIP(), []int{10}
+}
+
 var File_api_v1_log_proto protoreflect.FileDescriptor
 
 const file_api_v1_log_proto_rawDesc = "" +
 	"\n" +
-	"\x10api/v1/log.proto\x12\x06log.v1\"6\n" +
+	"\x10api/v1/log.proto\x12\x06log.v1\"\xc5\x01\n" +
 	"\x06Record\x12\x14\n" +
 	"\x05value\x18\x01 \x01(\fR\x05value\x12\x16\n" +
-	"\x06offset\x18\x02 \x01(\x04R\x06offset\"8\n" +
+	"\x06offset\x18\x02 \x01(\x04R\x06offset\x12\x1f\n" +
+	"\vproducer_id\x18\x03 \x01(\x04R\n" +
+	"producerId\x12\x1a\n" +
+	"\bsequence\x18\x04 \x01(\x04R\bsequence\x12%\n" +
+	"\x0etransaction_id\x18\x05 \x01(\x04R\rtransactionId\x12)\n" +
+	"\acontrol\x18\x06 \x01(\x0e2\x0f.log.v1.ControlR\acontrol\"\xde\x01\n" +
 	"\x0eProduceRequest\x12&\n" +
-	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\")\n" +
+	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\x12,\n" +
+	"\x0fexpected_offset\x18\x02 \x01(\x04H\x00R\x0eexpectedOffset\x88\x01\x01\x12\x1f\n" +
+	"\vproducer_id\x18\x03 \x01(\x04R\n" +
+	"producerId\x12\x1a\n" +
+	"\bsequence\x18\x04 \x01(\x04R\bsequence\x12%\n" +
+	"\x0etransaction_id\x18\x05 \x01(\x04R\rtransactionIdB\x12\n" +
+	"\x10_expected_offset\")\n" +
 	"\x0fProduceResponse\x12\x16\n" +
-	"\x06offset\x18\x01 \x01(\x04R\x06offset\"(\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\"i\n" +
 	"\x0eConsumeRequest\x12\x16\n" +
-	"\x06offset\x18\x01 \x01(\x04R\x06offset\"9\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12?\n" +
+	"\x0fisolation_level\x18\x02 \x01(\x0e2\x16.log.v1.IsolationLevelR\x0eisolationLevel\"9\n" +
 	"\x0fConsumeResponse\x12&\n" +
-	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record2\x8f\x02\n" +
+	"\x06record\x18\x01 \x01(\v2\x0e.log.v1.RecordR\x06record\"\xa5\x01\n" +
+	"\fFetchRequest\x12\x16\n" +
+	"\x06offset\x18\x01 \x01(\x04R\x06offset\x12\x1f\n" +
+	"\vmax_records\x18\x02 \x01(\rR\n" +
+	"maxRecords\x12\x1b\n" +
+	"\tmax_bytes\x18\x03 \x01(\x04R\bmaxBytes\x12?\n" +
+	"\x0fisolation_level\x18\x04 \x01(\x0e2\x16.log.v1.IsolationLevelR\x0eisolationLevel\"Z\n" +
+	"\rFetchResponse\x12(\n" +
+	"\arecords\x18\x01 \x03(\v2\x0e.log.v1.RecordR\arecords\x12\x1f\n" +
+	"\vnext_offset\x18\x02 \x01(\x04R\n" +
+	"nextOffset\"\x19\n" +
+	"\x17BeginTransactionRequest\"A\n" +
+	"\x18BeginTransactionResponse\x12%\n" +
+	"\x0etransaction_id\x18\x01 \x01(\x04R\rtransactionId\">\n" +
+	"\x15EndTransactionRequest\x12%\n" +
+	"\x0etransaction_id\x18\x01 \x01(\x04R\rtransactionId\"\x18\n" +
+	"\x16EndTransactionResponse*B\n" +
+	"\aControl\x12\x10\n" +
+	"\fCONTROL_NONE\x10\x00\x12\x12\n" +
+	"\x0eCONTROL_COMMIT\x10\x01\x12\x11\n" +
+	"\rCONTROL_ABORT\x10\x02*:\n" +
+	"\x0eIsolationLevel\x12\x14\n" +
+	"\x10READ_UNCOMMITTED\x10\x00\x12\x12\n" +
+	"\x0eREAD_COMMITTED\x10\x012\xcb\x04\n" +
 	"\x03Log\x12<\n" +
 	"\aProduce\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00\x12<\n" +
-	"\aConsume\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00\x12D\n" +
+	"\aConsume\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x00\x126\n" +
+	"\x05Fetch\x12\x14.log.v1.FetchRequest\x1a\x15.log.v1.FetchResponse\"\x00\x12W\n" +
+	"\x10BeginTransaction\x12\x1f.log.v1.BeginTransactionRequest\x1a .log.v1.BeginTransactionResponse\"\x00\x12T\n" +
+	"\x11CommitTransaction\x12\x1d.log.v1.EndTransactionRequest\x1a\x1e.log.v1.EndTransactionResponse\"\x00\x12S\n" +
+	"\x10AbortTransaction\x12\x1d.log.v1.EndTransactionRequest\x1a\x1e.log.v1.EndTransactionResponse\"\x00\x12D\n" +
 	"\rConsumeStream\x12\x16.log.v1.ConsumeRequest\x1a\x17.log.v1.ConsumeResponse\"\x000\x01\x12F\n" +
 	"\rProduceStream\x12\x16.log.v1.ProduceRequest\x1a\x17.log.v1.ProduceResponse\"\x00(\x010\x01B+Z)github.com/Devin-Yeung/proglog/api/log_v1b\x06proto3"
 
@@ -283,30 +794,51 @@ func file_api_v1_log_proto_rawDescGZIP() []byte {
 	return file_api_v1_log_proto_rawDescData
 }
 
-var file_api_v1_log_proto_msgTypes = make([]protoimpl.MessageInfo, 5)
+var file_api_v1_log_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_api_v1_log_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
 var file_api_v1_log_proto_goTypes = []any{
-	(*Record)(nil),          // 0: log.v1.Record
-	(*ProduceRequest)(nil),  // 1: log.v1.ProduceRequest
-	(*ProduceResponse)(nil), // 2: log.v1.ProduceResponse
-	(*ConsumeRequest)(nil),  // 3: log.v1.ConsumeRequest
-	(*ConsumeResponse)(nil), // 4: log.v1.ConsumeResponse
+	(Control)(0),                     // 0: log.v1.Control
+	(IsolationLevel)(0),              // 1: log.v1.IsolationLevel
+	(*Record)(nil),                   // 2: log.v1.Record
+	(*ProduceRequest)(nil),           // 3: log.v1.ProduceRequest
+	(*ProduceResponse)(nil),          // 4: log.v1.ProduceResponse
+	(*ConsumeRequest)(nil),           // 5: log.v1.ConsumeRequest
+	(*ConsumeResponse)(nil),          // 6: log.v1.ConsumeResponse
+	(*FetchRequest)(nil),             // 7: log.v1.FetchRequest
+	(*FetchResponse)(nil),            // 8: log.v1.FetchResponse
+	(*BeginTransactionRequest)(nil),  // 9: log.v1.BeginTransactionRequest
+	(*BeginTransactionResponse)(nil), // 10: log.v1.BeginTransactionResponse
+	(*EndTransactionRequest)(nil),    // 11: log.v1.EndTransactionRequest
+	(*EndTransactionResponse)(nil),   // 12: log.v1.EndTransactionResponse
 }
 var file_api_v1_log_proto_depIdxs = []int32{
-	0, // 0: log.v1.ProduceRequest.record:type_name -> log.v1.Record
-	0, // 1: log.v1.ConsumeResponse.record:type_name -> log.v1.Record
-	1, // 2: log.v1.Log.Produce:input_type -> log.v1.ProduceRequest
-	3, // 3: log.v1.Log.Consume:input_type -> log.v1.ConsumeRequest
-	3, // 4: log.v1.Log.ConsumeStream:input_type -> log.v1.ConsumeRequest
-	1, // 5: log.v1.Log.ProduceStream:input_type -> log.v1.ProduceRequest
-	2, // 6: log.v1.Log.Produce:output_type -> log.v1.ProduceResponse
-	4, // 7: log.v1.Log.Consume:output_type -> log.v1.ConsumeResponse
-	4, // 8: log.v1.Log.ConsumeStream:output_type -> log.v1.ConsumeResponse
-	2, // 9: log.v1.Log.ProduceStream:output_type -> log.v1.ProduceResponse
-	6, // [6:10] is the sub-list for method output_type
-	2, // [2:6] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	0,  // 0: log.v1.Record.control:type_name -> log.v1.Control
+	2,  // 1: log.v1.ProduceRequest.record:type_name -> log.v1.Record
+	1,  // 2: log.v1.ConsumeRequest.isolation_level:type_name -> log.v1.IsolationLevel
+	2,  // 3: log.v1.ConsumeResponse.record:type_name -> log.v1.Record
+	1,  // 4: log.v1.FetchRequest.isolation_level:type_name -> log.v1.IsolationLevel
+	2,  // 5: log.v1.FetchResponse.records:type_name -> log.v1.Record
+	3,  // 6: log.v1.Log.Produce:input_type -> log.v1.ProduceRequest
+	5,  // 7: log.v1.Log.Consume:input_type -> log.v1.ConsumeRequest
+	7,  // 8: log.v1.Log.Fetch:input_type -> log.v1.FetchRequest
+	9,  // 9: log.v1.Log.BeginTransaction:input_type -> log.v1.BeginTransactionRequest
+	11, // 10: log.v1.Log.CommitTransaction:input_type -> log.v1.EndTransactionRequest
+	11, // 11: log.v1.Log.AbortTransaction:input_type -> log.v1.EndTransactionRequest
+	5,  // 12: log.v1.Log.ConsumeStream:input_type -> log.v1.ConsumeRequest
+	3,  // 13: log.v1.Log.ProduceStream:input_type -> log.v1.ProduceRequest
+	4,  // 14: log.v1.Log.Produce:output_type -> log.v1.ProduceResponse
+	6,  // 15: log.v1.Log.Consume:output_type -> log.v1.ConsumeResponse
+	8,  // 16: log.v1.Log.Fetch:output_type -> log.v1.FetchResponse
+	10, // 17: log.v1.Log.BeginTransaction:output_type -> log.v1.BeginTransactionResponse
+	12, // 18: log.v1.Log.CommitTransaction:output_type -> log.v1.EndTransactionResponse
+	12, // 19: log.v1.Log.AbortTransaction:output_type -> log.v1.EndTransactionResponse
+	6,  // 20: log.v1.Log.ConsumeStream:output_type -> log.v1.ConsumeResponse
+	4,  // 21: log.v1.Log.ProduceStream:output_type -> log.v1.ProduceResponse
+	14, // [14:22] is the sub-list for method output_type
+	6,  // [6:14] is the sub-list for method input_type
+	6,  // [6:6] is the sub-list for extension type_name
+	6,  // [6:6] is the sub-list for extension extendee
+	0,  // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_api_v1_log_proto_init() }
@@ -314,18 +846,20 @@ func file_api_v1_log_proto_init() {
 	if File_api_v1_log_proto != nil {
 		return
 	}
+	file_api_v1_log_proto_msgTypes[1].OneofWrappers = []any{}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_v1_log_proto_rawDesc), len(file_api_v1_log_proto_rawDesc)),
-			NumEnums:      0,
-			NumMessages:   5,
+			NumEnums:      2,
+			NumMessages:   11,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
 		GoTypes:           file_api_v1_log_proto_goTypes,
 		DependencyIndexes: file_api_v1_log_proto_depIdxs,
+		EnumInfos:         file_api_v1_log_proto_enumTypes,
 		MessageInfos:      file_api_v1_log_proto_msgTypes,
 	}.Build()
 	File_api_v1_log_proto = out.File
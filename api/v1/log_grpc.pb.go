@@ -19,10 +19,14 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	Log_Produce_FullMethodName       = "/log.v1.Log/Produce"
-	Log_Consume_FullMethodName       = "/log.v1.Log/Consume"
-	Log_ConsumeStream_FullMethodName = "/log.v1.Log/ConsumeStream"
-	Log_ProduceStream_FullMethodName = "/log.v1.Log/ProduceStream"
+	Log_Produce_FullMethodName           = "/log.v1.Log/Produce"
+	Log_Consume_FullMethodName           = "/log.v1.Log/Consume"
+	Log_Fetch_FullMethodName             = "/log.v1.Log/Fetch"
+	Log_BeginTransaction_FullMethodName  = "/log.v1.Log/BeginTransaction"
+	Log_CommitTransaction_FullMethodName = "/log.v1.Log/CommitTransaction"
+	Log_AbortTransaction_FullMethodName  = "/log.v1.Log/AbortTransaction"
+	Log_ConsumeStream_FullMethodName     = "/log.v1.Log/ConsumeStream"
+	Log_ProduceStream_FullMethodName     = "/log.v1.Log/ProduceStream"
 )
 
 // LogClient is the client API for Log service.
@@ -31,6 +35,14 @@ const (
 type LogClient interface {
 	Produce(ctx context.Context, in *ProduceRequest, opts ...grpc.CallOption) (*ProduceResponse, error)
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
+	// Fetch returns many contiguous records at once
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error)
+	// BeginTransaction starts a transaction, whose records are appended by passing its id to Produce
+	BeginTransaction(ctx context.Context, in *BeginTransactionRequest, opts ...grpc.CallOption) (*BeginTransactionResponse, error)
+	// CommitTransaction makes the records of a transaction visible to READ_COMMITTED consumers, in all logs at once
+	CommitTransaction(ctx context.Context, in *EndTransactionRequest, opts ...grpc.CallOption) (*EndTransactionResponse, error)
+	// AbortTransaction discards the records of a transaction for READ_COMMITTED consumers
+	AbortTransaction(ctx context.Context, in *EndTransactionRequest, opts ...grpc.CallOption) (*EndTransactionResponse, error)
 	// Server streaming RPC: client sends a single request, server responds with a stream of messages
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ConsumeResponse], error)
 	// Bi-directional streaming RPC: client and server send a stream of messages to each other
@@ -65,6 +77,46 @@ func (c *logClient) Consume(ctx context.Context, in *ConsumeRequest, opts ...grp
 	return out, nil
 }
 
+func (c *logClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FetchResponse)
+	err := c.cc.Invoke(ctx, Log_Fetch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) BeginTransaction(ctx context.Context, in *BeginTransactionRequest, opts ...grpc.CallOption) (*BeginTransactionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BeginTransactionResponse)
+	err := c.cc.Invoke(ctx, Log_BeginTransaction_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) CommitTransaction(ctx context.Context, in *EndTransactionRequest, opts ...grpc.CallOption) (*EndTransactionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EndTransactionResponse)
+	err := c.cc.Invoke(ctx, Log_CommitTransaction_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) AbortTransaction(ctx context.Context, in *EndTransactionRequest, opts ...grpc.CallOption) (*EndTransactionResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EndTransactionResponse)
+	err := c.cc.Invoke(ctx, Log_AbortTransaction_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *logClient) ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ConsumeResponse], error) {
 	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
 	stream, err := c.cc.NewStream(ctx, &Log_ServiceDesc.Streams[0], Log_ConsumeStream_FullMethodName, cOpts...)
@@ -103,6 +155,14 @@ type Log_ProduceStreamClient = grpc.BidiStreamingClient[ProduceRequest, ProduceR
 type LogServer interface {
 	Produce(context.Context, *ProduceRequest) (*ProduceResponse, error)
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
+	// Fetch returns many contiguous records at once
+	Fetch(context.Context, *FetchRequest) (*FetchResponse, error)
+	// BeginTransaction starts a transaction, whose records are appended by passing its id to Produce
+	BeginTransaction(context.Context, *BeginTransactionRequest) (*BeginTransactionResponse, error)
+	// CommitTransaction makes the records of a transaction visible to READ_COMMITTED consumers, in all logs at once
+	CommitTransaction(context.Context, *EndTransactionRequest) (*EndTransactionResponse, error)
+	// AbortTransaction discards the records of a transaction for READ_COMMITTED consumers
+	AbortTransaction(context.Context, *EndTransactionRequest) (*EndTransactionResponse, error)
 	// Server streaming RPC: client sends a single request, server responds with a stream of messages
 	ConsumeStream(*ConsumeRequest, grpc.ServerStreamingServer[ConsumeResponse]) error
 	// Bi-directional streaming RPC: client and server send a stream of messages to each other
@@ -123,6 +183,18 @@ func (UnimplementedLogServer) Produce(context.Context, *ProduceRequest) (*Produc
 func (UnimplementedLogServer) Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "method Consume not implemented")
 }
+func (UnimplementedLogServer) Fetch(context.Context, *FetchRequest) (*FetchResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Fetch not implemented")
+}
+func (UnimplementedLogServer) BeginTransaction(context.Context, *BeginTransactionRequest) (*BeginTransactionResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method BeginTransaction not implemented")
+}
+func (UnimplementedLogServer) CommitTransaction(context.Context, *EndTransactionRequest) (*EndTransactionResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method CommitTransaction not implemented")
+}
+func (UnimplementedLogServer) AbortTransaction(context.Context, *EndTransactionRequest) (*EndTransactionResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method AbortTransaction not implemented")
+}
 func (UnimplementedLogServer) ConsumeStream(*ConsumeRequest, grpc.ServerStreamingServer[ConsumeResponse]) error {
 	return status.Error(codes.Unimplemented, "method ConsumeStream not implemented")
 }
@@ -186,6 +258,78 @@ func _Log_Consume_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Log_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).Fetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_Fetch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).Fetch(ctx, req.(*FetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_BeginTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BeginTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).BeginTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_BeginTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).BeginTransaction(ctx, req.(*BeginTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_CommitTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EndTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).CommitTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_CommitTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).CommitTransaction(ctx, req.(*EndTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_AbortTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EndTransactionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).AbortTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Log_AbortTransaction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).AbortTransaction(ctx, req.(*EndTransactionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Log_ConsumeStream_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(ConsumeRequest)
 	if err := stream.RecvMsg(m); err != nil {
@@ -219,6 +363,22 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Consume",
 			Handler:    _Log_Consume_Handler,
 		},
+		{
+			MethodName: "Fetch",
+			Handler:    _Log_Fetch_Handler,
+		},
+		{
+			MethodName: "BeginTransaction",
+			Handler:    _Log_BeginTransaction_Handler,
+		},
+		{
+			MethodName: "CommitTransaction",
+			Handler:    _Log_CommitTransaction_Handler,
+		},
+		{
+			MethodName: "AbortTransaction",
+			Handler:    _Log_AbortTransaction_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
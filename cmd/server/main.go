@@ -7,7 +7,7 @@ import (
 )
 
 func main() {
-	srv := server.NewHTTPServer(":8080")
+	srv := server.NewHTTPServer(":8080", server.NewLog())
 	defer srv.Close()
 
 	err := srv.ListenAndServe()
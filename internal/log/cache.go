@@ -0,0 +1,121 @@
+package log
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// segmentCache bounds the number of sealed segments whose files are open. Sealed segments are opened on demand by
+// readers, and once more than limit of them are open, the least recently used one is closed.
+//
+// The cache holds the owner's reference of every segment it keeps open, so a segment evicted while it is being read
+// is only closed when its readers are done. Recency is tracked with a clock that only advances when a read switches to
+// a segment other than the most recently used one, so that consecutive reads of a segment don't contend on it.
+type segmentCache struct {
+	// limit is the maximum number of sealed segments kept open.
+	limit int
+	// clock is the tick of the most recent read of a segment.
+	clock atomic.Int64
+	// mu guards open and closed, and serializes opening segments.
+	mu sync.Mutex
+	// open holds the sealed segments whose owner's reference is held by the cache.
+	open []*segment
+	// closed is set once the log is closed, after which no segment is opened anymore.
+	closed bool
+}
+
+// newSegmentCache creates a cache keeping at most limit sealed segments open.
+func newSegmentCache(limit int) *segmentCache {
+	return &segmentCache{limit: limit}
+}
+
+// acquire takes a reference on a sealed segment for a reader, opening its files if they are closed. It fails with
+// ErrOffsetOutOfRange if the segment was removed from the log, or the log is closed.
+func (c *segmentCache) acquire(s *segment) error {
+	if s.acquire() {
+		c.touch(s)
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrOffsetOutOfRange
+	}
+	opened, err := s.reopen()
+	if err != nil {
+		return err
+	}
+	s.used.Store(c.clock.Add(1))
+	if opened {
+		c.open = append(c.open, s)
+		return c.evict()
+	}
+	return nil
+}
+
+// add hands the owner's reference of a segment that was just sealed over to the cache.
+func (c *segmentCache) add(s *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s.used.Store(c.clock.Add(1))
+	c.open = append(c.open, s)
+	return c.evict()
+}
+
+// touch marks the segment as the most recently used.
+func (c *segmentCache) touch(s *segment) {
+	if s.used.Load() != c.clock.Load() {
+		s.used.Store(c.clock.Add(1))
+	}
+}
+
+// evict releases the least recently used segments until at most limit segments are open. The caller must hold c.mu.
+func (c *segmentCache) evict() error {
+	for len(c.open) > c.limit {
+		lru := 0
+		for i, s := range c.open {
+			if s.used.Load() < c.open[lru].used.Load() {
+				lru = i
+			}
+		}
+		s := c.open[lru]
+		c.open = slices.Delete(c.open, lru, lru+1)
+		if err := s.release(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove releases the owner's reference of a segment dropped from the log, if the cache holds it.
+func (c *segmentCache) remove(s *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := slices.Index(c.open, s)
+	if i < 0 {
+		return nil
+	}
+	c.open = slices.Delete(c.open, i, i+1)
+	return s.release()
+}
+
+// close releases the owner's references of all open segments, and prevents opening any other.
+func (c *segmentCache) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for len(c.open) > 0 {
+		s := c.open[0]
+		c.open = c.open[1:]
+		if err := s.release(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
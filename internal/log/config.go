@@ -1,13 +1,42 @@
 package log
 
-import "github.com/docker/go-units"
+import (
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// defaultMaxOpenSegments is the default number of sealed segments whose files are kept open, i.e. 256 descriptors and
+// as many memory mappings.
+const defaultMaxOpenSegments = 128
+
+// defaultMaxRecordBytes is the default maximum size of an encoded record, the default maximum message size of gRPC.
+const defaultMaxRecordBytes = 4 * units.MiB
 
 type Config struct {
 	segment struct {
 		maxStoreBytes uint64
 		maxIndexBytes uint64
 		initialOffset uint64
+		// indexIntervalBytes is the number of store bytes between two index entries, 0 means one entry per record.
+		indexIntervalBytes uint64
+		// maxRecords is the maximum number of records in a segment, 0 means as many as the format allows.
+		maxRecords uint64
+		// format is the format version of newly created segments.
+		format SegmentFormat
+		// maxAge is the age at which the active segment is rolled, 0 means segments don't expire.
+		maxAge time.Duration
 	}
+	// maxOpenSegments is the maximum number of sealed segments whose files are kept open.
+	maxOpenSegments int
+	// maxRecordBytes is the maximum size of an encoded record.
+	maxRecordBytes uint64
+	// readOnly opens the log without taking the directory lock, rejecting any modification.
+	readOnly bool
+	// now returns the current time, tests replace it to control the age of segments.
+	now func() time.Time
+	// fs holds the files of the log, tests replace it to inject faults.
+	fs filesystem
 }
 
 func NewConfig() *Config {
@@ -15,9 +44,30 @@ func NewConfig() *Config {
 	config.segment.maxStoreBytes = 1 * units.MiB
 	config.segment.maxIndexBytes = 1 * units.MiB
 	config.segment.initialOffset = 0
+	config.segment.format = SegmentFormatV1
+	config.maxOpenSegments = defaultMaxOpenSegments
+	config.maxRecordBytes = defaultMaxRecordBytes
+	config.now = time.Now
+	config.fs = osFS{}
 	return config
 }
 
+// clock returns the current time.
+func (c *Config) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
+
+// files returns the filesystem holding the files of the log.
+func (c *Config) files() filesystem {
+	if c.fs == nil {
+		return osFS{}
+	}
+	return c.fs
+}
+
 func (c *Config) WithSegmentMaxStoreBytes(bytes uint64) *Config {
 	if bytes == 0 {
 		bytes = 1 * units.MiB
@@ -38,3 +88,77 @@ func (c *Config) WithSegmentInitialOffset(offset uint64) *Config {
 	c.segment.initialOffset = offset
 	return c
 }
+
+// WithSegmentIndexIntervalBytes makes the segment index sparse: an index entry is only written once at least the given
+// number of bytes have been appended to the store since the previous entry, and records in between are found by
+// scanning the store forward from the nearest entry. A value of 0 (the default) indexes every record.
+func (c *Config) WithSegmentIndexIntervalBytes(bytes uint64) *Config {
+	c.segment.indexIntervalBytes = bytes
+	return c
+}
+
+// WithSegmentMaxRecords limits the number of records in a segment. The limit is capped by the number of relative offsets
+// the segment format can index, a value of 0 (the default) only applies that cap.
+func (c *Config) WithSegmentMaxRecords(n uint64) *Config {
+	c.segment.maxRecords = n
+	return c
+}
+
+// WithSegmentFormat sets the format version of newly created segments. Existing segments keep the format version they
+// were created with. Unsupported versions fall back to SegmentFormatV1.
+func (c *Config) WithSegmentFormat(format SegmentFormat) *Config {
+	if !format.supported() {
+		format = SegmentFormatV1
+	}
+	c.segment.format = format
+	return c
+}
+
+// WithSegmentMaxAge rolls the active segment once it is older than the given age, so that a log with little traffic
+// still seals its segments and old records can be truncated. The age is checked before every append, and periodically
+// in the background for a log that isn't appended to, at half the age but at most every millisecond. An empty segment
+// is never rolled. A value of 0 (the default) disables rolling by age.
+func (c *Config) WithSegmentMaxAge(age time.Duration) *Config {
+	c.segment.maxAge = max(age, 0)
+	return c
+}
+
+// WithMaxRecordBytes limits the size of an encoded record. Appending a larger record fails with ErrRecordTooLarge, and
+// so does reading one, which guards against allocating for a corrupted length prefix. Lowering the limit thus makes
+// larger records written before unreadable. A value of 0 sets the default of 4 MiB.
+func (c *Config) WithMaxRecordBytes(bytes uint64) *Config {
+	if bytes == 0 {
+		bytes = defaultMaxRecordBytes
+	}
+	c.maxRecordBytes = bytes
+	return c
+}
+
+// WithReadOnly opens the log in read-only mode. A read-only log does not take the directory lock, so it can be opened
+// while another process writes to the log, and sees the records that were on disk when it was opened. Appending to or
+// truncating a read-only log fails with ErrReadOnly.
+func (c *Config) WithReadOnly() *Config {
+	c.readOnly = true
+	return c
+}
+
+// WithInMemory keeps the log in memory rather than in files, for tests and short-lived logs that need no durability.
+// The log is segmented, rolled and truncated as on disk, and the directory only names it: logs opened with the config,
+// or copies of it, share the memory, so a log that is closed and opened again still holds its records, until the
+// process exits.
+func (c *Config) WithInMemory() *Config {
+	c.fs = newMemFS()
+	return c
+}
+
+// WithMaxOpenSegments limits the number of sealed segments (all but the active one) whose files are kept open. Sealed
+// segments are opened when read, and the least recently read ones are closed beyond the limit, so that the number of
+// file descriptors and memory mappings doesn't grow with the log. Segments in use by readers are only closed once the
+// reads are done. A value of 0 sets the default of 128.
+func (c *Config) WithMaxOpenSegments(n int) *Config {
+	if n <= 0 {
+		n = defaultMaxOpenSegments
+	}
+	c.maxOpenSegments = n
+	return c
+}
@@ -2,6 +2,7 @@ package log
 
 import (
 	"testing"
+	"time"
 
 	"github.com/docker/go-units"
 	"github.com/stretchr/testify/assert"
@@ -12,13 +13,31 @@ func TestDefaultConfig(t *testing.T) {
 
 	assert.Equal(t, c.segment.maxIndexBytes, uint64(1*units.MiB))
 	assert.Equal(t, c.segment.maxStoreBytes, uint64(1*units.MiB))
+	assert.Equal(t, c.segment.indexIntervalBytes, uint64(0))
+	assert.Equal(t, c.segment.maxRecords, uint64(0))
+	assert.Equal(t, c.segment.format, SegmentFormatV1)
+	assert.Equal(t, c.maxOpenSegments, defaultMaxOpenSegments)
+	assert.Equal(t, c.segment.maxAge, time.Duration(0))
+	assert.Equal(t, c.maxRecordBytes, uint64(4*units.MiB))
 }
 
 func TestNonDefaultConfig(t *testing.T) {
 	c := NewConfig().
 		WithSegmentMaxIndexBytes(10 * units.MiB).
-		WithSegmentMaxStoreBytes(100 * units.MiB)
+		WithSegmentMaxStoreBytes(100 * units.MiB).
+		WithSegmentIndexIntervalBytes(4 * units.KiB).
+		WithSegmentMaxRecords(1000).
+		WithSegmentFormat(SegmentFormatV2).
+		WithMaxOpenSegments(16).
+		WithSegmentMaxAge(24 * time.Hour).
+		WithMaxRecordBytes(64 * units.KiB)
 
 	assert.Equal(t, c.segment.maxIndexBytes, uint64(10*units.MiB))
 	assert.Equal(t, c.segment.maxStoreBytes, uint64(100*units.MiB))
+	assert.Equal(t, c.segment.indexIntervalBytes, uint64(4*units.KiB))
+	assert.Equal(t, c.segment.maxRecords, uint64(1000))
+	assert.Equal(t, c.segment.format, SegmentFormatV2)
+	assert.Equal(t, c.maxOpenSegments, 16)
+	assert.Equal(t, c.segment.maxAge, 24*time.Hour)
+	assert.Equal(t, c.maxRecordBytes, uint64(64*units.KiB))
 }
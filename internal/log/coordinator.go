@@ -0,0 +1,169 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+)
+
+// ErrUnknownTransaction is returned when appending to, committing or aborting a transaction that was not begun by the
+// coordinator, or ended already.
+var ErrUnknownTransaction = fmt.Errorf("unknown transaction")
+
+// Coordinator runs transactions spanning one or more logs. Records appended in a transaction are hidden from
+// read-committed consumers (see Log.StableOffset and Log.Aborted) until the transaction ends with a commit or abort
+// marker in every log it appended to.
+//
+// Commits are atomic across logs: the coordinator records its decision in a log of its own before writing the commit
+// markers, so that a crash in between is completed when the coordinator is opened again. Transactions without a
+// recorded commit are aborted then, in every log.
+type Coordinator struct {
+	// log records the transactions: a record per begun transaction, whose offset + 1 is the transaction id, and a
+	// commit marker per committed transaction.
+	log *Log
+	// logs are the logs transactions may append to.
+	logs []*Log
+	// mu guards active. Appends hold it for reading, so that a transaction does not end while appending to it.
+	mu sync.RWMutex
+	// active holds the ids of the transactions begun and not ended yet.
+	active map[uint64]struct{}
+}
+
+// NewCoordinator opens the coordinator whose decisions are recorded in the log in the given directory, running
+// transactions across the given logs. Transactions left open by a crash are committed if the coordinator decided so
+// before the crash, and aborted otherwise.
+func NewCoordinator(dir string, c Config, logs ...*Log) (*Coordinator, error) {
+	l, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	co := &Coordinator{
+		log:    l,
+		logs:   logs,
+		active: make(map[uint64]struct{}),
+	}
+	if err := co.recover(); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return co, nil
+}
+
+// recover ends the transactions left open in the logs, according to the decisions recorded before.
+func (c *Coordinator) recover() error {
+	committed := make(map[uint64]struct{})
+	lowest, err := c.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	for from := lowest; ; {
+		records, next, err := c.log.ReadRange(from, 0, 0)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			if record.Control == api.Control_CONTROL_COMMIT {
+				committed[record.TransactionId] = struct{}{}
+			}
+		}
+		from = next
+	}
+
+	for _, l := range c.logs {
+		for _, id := range l.openTransactions() {
+			_, commit := committed[id]
+			if err := l.endTransaction(context.Background(), id, commit); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Begin starts a transaction and returns its id.
+func (c *Coordinator) Begin(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset, err := c.log.AppendContext(ctx, &api.Record{})
+	if err != nil {
+		return 0, err
+	}
+	// the record must be on disk before the id is used, an id given out again after a crash would mix the
+	// transactions up
+	if err := c.log.flush(); err != nil {
+		return 0, err
+	}
+	// ids start at 1, 0 tells records outside of transactions
+	id := offset + 1
+	c.active[id] = struct{}{}
+	return id, nil
+}
+
+// Append appends the record to the log in the transaction. The log must be one of the coordinator's.
+func (c *Coordinator) Append(ctx context.Context, l *Log, id uint64, record *api.Record) (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if _, ok := c.active[id]; !ok {
+		return 0, fmt.Errorf("%w: %d", ErrUnknownTransaction, id)
+	}
+	if !slices.Contains(c.logs, l) {
+		return 0, fmt.Errorf("log %s does not take part in transactions of the coordinator", l.Dir)
+	}
+	record.TransactionId, record.Control = id, api.Control_CONTROL_NONE
+	return l.AppendContext(ctx, record)
+}
+
+// Commit makes the records of the transaction visible to read-committed consumers of all logs. Once the decision is
+// recorded, the transaction is committed even if writing a marker fails: the markers are written again when the
+// coordinator is opened again.
+func (c *Coordinator) Commit(ctx context.Context, id uint64) error {
+	return c.end(ctx, id, true)
+}
+
+// Abort discards the records of the transaction for read-committed consumers of all logs.
+func (c *Coordinator) Abort(ctx context.Context, id uint64) error {
+	return c.end(ctx, id, false)
+}
+
+// end ends the transaction in all logs.
+func (c *Coordinator) end(ctx context.Context, id uint64, commit bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.active[id]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownTransaction, id)
+	}
+	if commit {
+		// the decision must be on disk before any marker
+		if _, err := c.log.AppendContext(ctx, &api.Record{TransactionId: id, Control: api.Control_CONTROL_COMMIT}); err != nil {
+			return err
+		}
+		if err := c.log.flush(); err != nil {
+			return err
+		}
+	}
+	delete(c.active, id)
+
+	// the transaction is decided, write all markers regardless of the context
+	var errs []error
+	for _, l := range c.logs {
+		errs = append(errs, l.endTransaction(context.WithoutCancel(ctx), id, commit))
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the log of the coordinator. The logs of the transactions are left open.
+func (c *Coordinator) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.log.Close()
+}
@@ -0,0 +1,164 @@
+package log
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// committed returns the values of the records a read-committed consumer of the log sees.
+func committed(t *testing.T, l *Log) []string {
+	t.Helper()
+	var values []string
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	for offset := lowest; offset < l.StableOffset(); offset++ {
+		record, err := l.Read(offset)
+		require.NoError(t, err)
+		if record.Control == api.Control_CONTROL_NONE && !l.Aborted(record) {
+			values = append(values, string(record.Value))
+		}
+	}
+	return values
+}
+
+func TestCoordinator(t *testing.T) {
+	ctx := context.Background()
+	config := NewConfig().WithSegmentMaxStoreBytes(128)
+	dirs := [3]string{t.TempDir(), t.TempDir(), t.TempDir()}
+
+	open := func(t *testing.T) (*Coordinator, *Log, *Log) {
+		a, err := NewLog(dirs[0], *config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = a.Close() })
+		b, err := NewLog(dirs[1], *config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = b.Close() })
+		c, err := NewCoordinator(dirs[2], *config, a, b)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = c.Close() })
+		return c, a, b
+	}
+
+	t.Run("commit and abort", func(t *testing.T) {
+		c, a, b := open(t)
+
+		_, err := a.Append(&api.Record{Value: []byte("plain")})
+		require.NoError(t, err)
+
+		committedID, err := c.Begin(ctx)
+		require.NoError(t, err)
+		abortedID, err := c.Begin(ctx)
+		require.NoError(t, err)
+		require.NotEqual(t, committedID, abortedID)
+
+		for i := 0; i < 10; i++ {
+			_, err = c.Append(ctx, a, committedID, &api.Record{Value: []byte("committed")})
+			require.NoError(t, err)
+			_, err = c.Append(ctx, b, committedID, &api.Record{Value: []byte("committed")})
+			require.NoError(t, err)
+			_, err = c.Append(ctx, a, abortedID, &api.Record{Value: []byte("aborted")})
+			require.NoError(t, err)
+		}
+		// the open transactions hide their records
+		assert.Equal(t, []string{"plain"}, committed(t, a))
+		assert.Empty(t, committed(t, b))
+
+		require.NoError(t, c.Abort(ctx, abortedID))
+		assert.Equal(t, []string{"plain"}, committed(t, a))
+
+		require.NoError(t, c.Commit(ctx, committedID))
+		assert.Len(t, committed(t, a), 11)
+		assert.NotContains(t, committed(t, a), "aborted")
+		assert.Len(t, committed(t, b), 10)
+
+		// ended transactions take no more records
+		_, err = c.Append(ctx, a, committedID, &api.Record{Value: []byte("late")})
+		require.ErrorIs(t, err, ErrUnknownTransaction)
+		require.ErrorIs(t, c.Commit(ctx, abortedID), ErrUnknownTransaction)
+	})
+
+	t.Run("survives restarts", func(t *testing.T) {
+		c, a, b := open(t)
+		want := [2][]string{committed(t, a), committed(t, b)}
+		require.NoError(t, c.Close())
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+
+		_, a, b = open(t)
+		assert.Equal(t, want, [2][]string{committed(t, a), committed(t, b)})
+	})
+
+	t.Run("recovers interrupted commits", func(t *testing.T) {
+		c, a, b := open(t)
+		before := [2]int{len(committed(t, a)), len(committed(t, b))}
+
+		decided, err := c.Begin(ctx)
+		require.NoError(t, err)
+		undecided, err := c.Begin(ctx)
+		require.NoError(t, err)
+		for _, l := range []*Log{a, b} {
+			_, err = c.Append(ctx, l, decided, &api.Record{Value: []byte("decided")})
+			require.NoError(t, err)
+			_, err = c.Append(ctx, l, undecided, &api.Record{Value: []byte("undecided")})
+			require.NoError(t, err)
+		}
+
+		// crash after recording the decision and writing the marker to the first log only
+		_, err = c.log.Append(&api.Record{TransactionId: decided, Control: api.Control_CONTROL_COMMIT})
+		require.NoError(t, err)
+		require.NoError(t, a.endTransaction(ctx, decided, true))
+		require.NoError(t, c.Close())
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+
+		_, a, b = open(t)
+		assert.Equal(t, before[0]+1, len(committed(t, a)))
+		assert.Equal(t, before[1]+1, len(committed(t, b)))
+		assert.Empty(t, a.openTransactions())
+		assert.Empty(t, b.openTransactions())
+		assert.Equal(t, a.StableOffset(), a.end())
+	})
+
+	t.Run("never reuses ids after a crash", func(t *testing.T) {
+		c, a, b := open(t)
+		require.NoError(t, c.Close())
+		c, fs := openFaultyCoordinator(t, dirs[2], config, a, b)
+
+		aborted, err := c.Begin(ctx)
+		require.NoError(t, err)
+		_, err = c.Append(ctx, a, aborted, &api.Record{Value: []byte("aborted")})
+		require.NoError(t, err)
+		require.NoError(t, c.Abort(ctx, aborted))
+
+		// crash, losing what the coordinator did not write out
+		fs.inject(fault{crash: true})
+		_ = c.Close()
+		require.NoError(t, a.Close())
+		require.NoError(t, b.Close())
+
+		c, a, _ = open(t)
+		committedID, err := c.Begin(ctx)
+		require.NoError(t, err)
+		require.NotEqual(t, aborted, committedID)
+		_, err = c.Append(ctx, a, committedID, &api.Record{Value: []byte("committed")})
+		require.NoError(t, err)
+		require.NoError(t, c.Commit(ctx, committedID))
+		assert.NotContains(t, committed(t, a), "aborted")
+		assert.Contains(t, committed(t, a), "committed")
+	})
+}
+
+// openFaultyCoordinator opens the coordinator in the directory on a faultFS, running transactions across the logs.
+func openFaultyCoordinator(t *testing.T, dir string, config *Config, logs ...*Log) (*Coordinator, *faultFS) {
+	t.Helper()
+	fs := &faultFS{}
+	c := *config
+	c.fs = fs
+	co, err := NewCoordinator(dir, c, logs...)
+	require.NoError(t, err)
+	return co, fs
+}
@@ -0,0 +1,109 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/tysonmote/gommap"
+)
+
+// file is an open file of a filesystem. *os.File implements it.
+type file interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// filesystem is the storage the segments, snapshots and manifest of a log are kept in: the files of the operating
+// system, or memory (see Config.WithInMemory). The log only touches its files through it, so that tests can inject
+// faults.
+type filesystem interface {
+	// Lock takes the exclusive lock of a log directory until the returned lock is closed, or fails with ErrLogLocked.
+	Lock(dir string) (io.Closer, error)
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	// SyncDir flushes the directory entry changes (creations, renames, removals) of the directory to disk.
+	SyncDir(name string) error
+	// Map maps the first length bytes of the file into memory, the whole file if length is -1. Writes to a writable
+	// mapping go to the file. The file may be closed while it is mapped.
+	Map(f file, length int64, writable bool) ([]byte, error)
+	// SyncMap flushes the writes to the mapping to the file.
+	SyncMap(m []byte) error
+	// Unmap releases the mapping, which must not be used afterward.
+	Unmap(m []byte) error
+}
+
+// osFS is the filesystem of the operating system.
+type osFS struct{}
+
+func (osFS) Lock(dir string) (io.Closer, error) {
+	f, err := lockDir(dir)
+	if err != nil {
+		return nil, err // not a nil *os.File in a non-nil io.Closer
+	}
+	return f, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // not a nil *os.File in a non-nil file
+	}
+	return f, nil
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) SyncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+func (osFS) Map(f file, length int64, writable bool) ([]byte, error) {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil, errors.New("file of another filesystem")
+	}
+	prot := gommap.PROT_READ
+	if writable {
+		prot |= gommap.PROT_WRITE
+	}
+	return gommap.MapRegion(fd.Fd(), 0, length, prot, gommap.MAP_SHARED)
+}
+
+func (osFS) SyncMap(m []byte) error {
+	return gommap.MMap(m).Sync(gommap.MS_SYNC)
+}
+
+func (osFS) Unmap(m []byte) error {
+	return gommap.MMap(m).UnsafeUnmap()
+}
@@ -0,0 +1,364 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errCrashed is returned by every operation of a crashed faultFS.
+var errCrashed = errors.New("crashed")
+
+// fault makes operations on the files of a faultFS fail.
+type fault struct {
+	// op is the operation that fails: "open", "write", "sync", "truncate", "map", "rename" or "remove". An empty op
+	// matches every operation that changes files.
+	op string
+	// name is a part of the base name of the files affected, e.g. ".store", empty for all files.
+	name string
+	// after is the number of matching operations that succeed before the fault strikes.
+	after int
+	// err is the error of the failing operations.
+	err error
+	// short makes a failing write write half of its bytes first.
+	short bool
+	// crash makes the fault crash the filesystem: every operation that changes files fails from then on, as if the
+	// process had died. What was written before stays, memory mappings included.
+	crash bool
+}
+
+// faultFS is a filesystem injecting faults into the operations of the OS filesystem. Operations reading files are
+// never faulted.
+type faultFS struct {
+	osFS
+	mu      sync.Mutex
+	faults  []*fault
+	crashed bool
+}
+
+// inject adds a fault, which strikes until it is cleared.
+func (fs *faultFS) inject(f fault) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = append(fs.faults, &f)
+}
+
+// clear removes all faults. A crashed filesystem stays crashed.
+func (fs *faultFS) clear() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.faults = nil
+}
+
+// fail returns the fault hitting the operation on the named file, nil if it succeeds.
+func (fs *faultFS) fail(op, name string) *fault {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.crashed {
+		return &fault{err: errCrashed}
+	}
+	for _, f := range fs.faults {
+		if f.op != "" && f.op != op || !strings.Contains(path.Base(name), f.name) {
+			continue
+		}
+		if f.after > 0 {
+			f.after--
+			continue
+		}
+		if f.crash {
+			fs.crashed = true
+			return &fault{err: errCrashed}
+		}
+		return f
+	}
+	return nil
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	if f := fs.fail("open", name); f != nil {
+		return nil, f.err
+	}
+	f, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{file: f, fs: fs}, nil
+}
+
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+	if f := fs.fail("rename", newpath); f != nil {
+		return f.err
+	}
+	return fs.osFS.Rename(oldpath, newpath)
+}
+
+func (fs *faultFS) Remove(name string) error {
+	if f := fs.fail("remove", name); f != nil {
+		return f.err
+	}
+	return fs.osFS.Remove(name)
+}
+
+func (fs *faultFS) SyncDir(name string) error {
+	if f := fs.fail("sync", name); f != nil {
+		return f.err
+	}
+	return fs.osFS.SyncDir(name)
+}
+
+func (fs *faultFS) Map(f file, length int64, writable bool) ([]byte, error) {
+	ff := f.(*faultFile)
+	if f := fs.fail("map", ff.Name()); f != nil {
+		return nil, f.err
+	}
+	return fs.osFS.Map(ff.file, length, writable)
+}
+
+func (fs *faultFS) SyncMap(m []byte) error {
+	if f := fs.fail("sync", ""); f != nil {
+		return f.err
+	}
+	return fs.osFS.SyncMap(m)
+}
+
+// faultFile is a file of a faultFS.
+type faultFile struct {
+	file
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if fault := f.fs.fail("write", f.Name()); fault != nil {
+		if !fault.short {
+			return 0, fault.err
+		}
+		n, _ := f.file.Write(p[:len(p)/2])
+		return n, fault.err
+	}
+	return f.file.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if fault := f.fs.fail("sync", f.Name()); fault != nil {
+		return fault.err
+	}
+	return f.file.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if fault := f.fs.fail("truncate", f.Name()); fault != nil {
+		return fault.err
+	}
+	return f.file.Truncate(size)
+}
+
+// openFaulty opens a log on a faultFS in the directory.
+func openFaulty(t *testing.T, dir string, config *Config) (*Log, *faultFS) {
+	t.Helper()
+	fs := &faultFS{}
+	config.fs = fs
+	log, err := NewLog(dir, *config)
+	require.NoError(t, err)
+	return log, fs
+}
+
+// valueAt is the value of the record appended at the offset by the tests of faults.
+func valueAt(offset uint64) []byte {
+	return []byte(fmt.Sprintf("record %d %s", offset, strings.Repeat("x", int(offset%50))))
+}
+
+// appendUntil appends records until an append fails, at most n, and returns the error.
+func appendUntil(t *testing.T, log *Log, n int) error {
+	t.Helper()
+	for range n {
+		next := log.end()
+		offset, err := log.Append(&api.Record{Value: valueAt(next)})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, next, offset)
+	}
+	return nil
+}
+
+// requireIntact checks that the log holds the records from its lowest offset to its end, with their values.
+func requireIntact(t *testing.T, log *Log) {
+	t.Helper()
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	for offset := lowest; offset < log.end(); offset++ {
+		record, err := log.Read(offset)
+		if assert.NoError(t, err, "offset %d", offset) {
+			assert.Equal(t, valueAt(offset), record.Value, "offset %d", offset)
+		}
+	}
+	records, next, err := log.ReadRange(lowest, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, int(log.end()-lowest))
+	require.Equal(t, log.end(), next)
+}
+
+// reopen closes the log, which may fail after a crash, and opens it again on the OS filesystem.
+func reopen(t *testing.T, log *Log, config *Config) *Log {
+	t.Helper()
+	_ = log.Close()
+	config.fs = osFS{}
+	log, err := NewLog(log.Dir, *config)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = log.Close() })
+	return log
+}
+
+func TestLogAppendFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		fault fault
+	}{
+		{name: "store write", fault: fault{op: "write", name: ".store", err: syscall.ENOSPC}},
+		{name: "short store write", fault: fault{op: "write", name: ".store", err: syscall.ENOSPC, short: true}},
+		{name: "index growth", fault: fault{op: "truncate", name: ".index", err: syscall.ENOSPC}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, config := range []*Config{
+				NewConfig(),
+				NewConfig().WithSegmentIndexIntervalBytes(256),
+			} {
+				log, fs := openFaulty(t, t.TempDir(), config)
+				fs.inject(tc.fault)
+
+				end := log.end()
+				err := appendUntil(t, log, 30000)
+				require.ErrorIs(t, err, syscall.ENOSPC)
+				// the failed record left no trace
+				requireIntact(t, log)
+				_, err = log.Read(log.end())
+				require.ErrorIs(t, err, ErrOffsetOutOfRange)
+				require.Greater(t, log.end(), end)
+
+				fs.clear()
+				require.NoError(t, appendUntil(t, log, 100))
+				requireIntact(t, log)
+				requireIntact(t, reopen(t, log, config))
+			}
+		})
+	}
+}
+
+func TestLogRollFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		fault fault
+	}{
+		{name: "snapshot", fault: fault{op: "write", name: ".snapshot", err: syscall.ENOSPC}},
+		{name: "new segment", fault: fault{op: "open", name: ".store", err: syscall.EMFILE}},
+		{name: "seal", fault: fault{op: "map", name: ".store", err: syscall.ENOMEM}},
+		{name: "manifest", fault: fault{op: "rename", name: manifestName, err: syscall.EIO}},
+		{name: "manifest sync", fault: fault{op: "sync", name: manifestName, err: syscall.EIO}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewConfig().WithSegmentMaxStoreBytes(256)
+			log, fs := openFaulty(t, t.TempDir(), config)
+			// a producer, so that rolls write a snapshot
+			_, err := log.Append(&api.Record{Value: valueAt(0), ProducerId: 1})
+			require.NoError(t, err)
+			fs.inject(tc.fault)
+
+			// the record filling the segment is appended, the roll is retried by the next append
+			err = appendUntil(t, log, 100)
+			require.Error(t, err)
+			require.ErrorIs(t, err, tc.fault.err)
+			requireIntact(t, log)
+
+			fs.clear()
+			require.NoError(t, appendUntil(t, log, 100))
+			require.Greater(t, len(log.segments), 2)
+			requireIntact(t, log)
+
+			log = reopen(t, log, config)
+			requireIntact(t, log)
+			require.Greater(t, len(log.segments), 2)
+		})
+	}
+}
+
+func TestLogTruncateFaults(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		fault fault
+		// dropped reports whether the truncation is complete despite the fault
+		dropped bool
+	}{
+		{name: "manifest", fault: fault{op: "rename", name: manifestName, err: syscall.EIO}},
+		{name: "remove", fault: fault{op: "remove", name: ".store", err: syscall.EACCES}, dropped: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := NewConfig().WithSegmentMaxStoreBytes(256)
+			log, fs := openFaulty(t, t.TempDir(), config)
+			require.NoError(t, appendUntil(t, log, 100))
+			segments := len(log.segments)
+			lowest := log.segments[2].baseOffset
+
+			fs.inject(tc.fault)
+			require.ErrorIs(t, log.Truncate(lowest), tc.fault.err)
+			requireIntact(t, log)
+			if !tc.dropped {
+				require.Len(t, log.segments, segments)
+				// the records are still there, and the truncation can be retried
+				fs.clear()
+				require.NoError(t, log.Truncate(lowest))
+			}
+			require.Len(t, log.segments, segments-2)
+			requireIntact(t, log)
+
+			log = reopen(t, log, config)
+			requireIntact(t, log)
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err)
+			require.Equal(t, log.segments[0].baseOffset, lowest)
+			if tc.dropped {
+				// the files that could not be removed are left behind
+				require.NotEmpty(t, log.Orphans())
+			}
+		})
+	}
+}
+
+func TestLogCrash(t *testing.T) {
+	for name, config := range map[string]func() *Config{
+		"dense index": func() *Config {
+			return NewConfig().WithSegmentMaxStoreBytes(256)
+		},
+		"sparse index": func() *Config {
+			return NewConfig().WithSegmentMaxStoreBytes(256).WithSegmentIndexIntervalBytes(64)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// crash after every number of operations changing files, while appending, rolling and truncating
+			for ops := 0; ops < 110; ops++ {
+				log, fs := openFaulty(t, t.TempDir(), config())
+				fs.inject(fault{crash: true, after: ops})
+
+				if appendUntil(t, log, 15) == nil && log.Truncate(log.segments[1].baseOffset) == nil {
+					_ = appendUntil(t, log, 15)
+				}
+
+				// records that were not written before the crash are lost, the others are intact
+				log = reopen(t, log, config())
+				requireIntact(t, log)
+				require.NoError(t, appendUntil(t, log, 15), "crash after %d operations", ops)
+				requireIntact(t, log)
+				requireIntact(t, reopen(t, log, config()))
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// The fuzz targets feed arbitrary file contents to the store, the index and the segment, as found on disk after a
+// crash, a bug or a bit flip. They must never panic, and fail with the errors of the package. The seeds are valid
+// files written by the package, the corpus in testdata/fuzz holds inputs that found bugs and interesting mutations.
+
+// fuzzConfig returns the in-memory config of the fuzz targets, with small limits so that mutations reach them.
+func fuzzConfig() *Config {
+	return NewConfig().
+		WithSegmentMaxStoreBytes(4096).
+		WithSegmentMaxIndexBytes(4096).
+		WithMaxRecordBytes(256).
+		WithInMemory()
+}
+
+// fuzzSegmentFiles returns the contents of the store and index files of a segment at base offset 0 holding n records.
+func fuzzSegmentFiles(f *testing.F, config *Config, n int) ([]byte, []byte) {
+	config.WithInMemory()
+	s, err := newSegment("seg", 0, *config)
+	require.NoError(f, err)
+	for i := range n {
+		_, err := s.Append(&api.Record{Value: bytes.Repeat([]byte{byte(i)}, i)})
+		require.NoError(f, err)
+	}
+	require.NoError(f, s.Close())
+
+	store, err := config.files().ReadFile(segmentPath("seg", 0, "store"))
+	require.NoError(f, err)
+	index, err := config.files().ReadFile(segmentPath("seg", 0, "index"))
+	require.NoError(f, err)
+	return store, index
+}
+
+// fuzzSeeds returns the files of valid segments: empty, dense and sparse, in both formats, and legacy.
+func fuzzSeeds(f *testing.F) [][2][]byte {
+	var seeds [][2][]byte
+	for _, config := range []*Config{
+		fuzzConfig(),
+		fuzzConfig().WithSegmentIndexIntervalBytes(64),
+		fuzzConfig().WithSegmentFormat(SegmentFormatV1),
+	} {
+		for _, n := range []int{0, 1, 20} {
+			store, index := fuzzSegmentFiles(f, config, n)
+			seeds = append(seeds, [2][]byte{store, index})
+		}
+	}
+	// a legacy segment is a V1 segment without headers
+	store, index := fuzzSegmentFiles(f, fuzzConfig().WithSegmentFormat(SegmentFormatV1), 20)
+	legacy := bytes.Clone(index[headerWidth:])
+	for i := 0; i+12 <= len(legacy); i += 12 {
+		pos := byteOrder.Uint64(legacy[i+4:]) - headerWidth
+		byteOrder.PutUint64(legacy[i+4:], pos)
+	}
+	seeds = append(seeds, [2][]byte{store[headerWidth:], legacy})
+	return seeds
+}
+
+// writeFuzzFile writes the contents of a file of the filesystem, unless they are nil.
+func writeFuzzFile(t *testing.T, fs filesystem, name string, p []byte) {
+	t.Helper()
+	if p == nil {
+		return
+	}
+	f, err := fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(p)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// requireTyped checks that an error is one of the errors reading corrupted files may fail with.
+func requireTyped(t *testing.T, err error) {
+	t.Helper()
+	for _, target := range []error{
+		io.EOF,
+		ErrInvalidSegment,
+		ErrUnsupportedFormat,
+		ErrRecordTooLarge,
+		ErrOffsetOverflow,
+		ErrSegmentFull,
+		proto.Error,
+	} {
+		if errors.Is(err, target) {
+			return
+		}
+	}
+	t.Fatalf("unexpected error: %v", err)
+}
+
+func FuzzStore(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed[0], uint64(headerWidth))
+		f.Add(seed[0], uint64(len(seed[0])))
+	}
+	f.Add([]byte("PLGSTORE"), uint64(math.MaxUint64-3))
+	f.Add([]byte("PLGSTORE"), uint64(math.MaxInt64+1))
+
+	f.Fuzz(func(t *testing.T, data []byte, pos uint64) {
+		config := fuzzConfig()
+		writeFuzzFile(t, config.files(), "store", data)
+		file, err := config.files().OpenFile("store", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		s, err := newStore(file, *config, newHeader(0, *config))
+		if err != nil {
+			requireTyped(t, err)
+			return
+		}
+		defer s.Close()
+
+		// read from the file, then from the mapping of a sealed store
+		for range 2 {
+			if p, err := s.Read(pos); err != nil {
+				requireTyped(t, err)
+			} else {
+				assert.LessOrEqual(t, uint64(len(p)), config.maxRecordBytes)
+			}
+			if p, err := s.View(pos); err != nil {
+				requireTyped(t, err)
+			} else {
+				assert.LessOrEqual(t, uint64(len(p)), config.maxRecordBytes)
+			}
+			if next, err := s.Next(pos); err != nil {
+				requireTyped(t, err)
+			} else {
+				assert.Greater(t, next, pos)
+			}
+			require.NoError(t, s.Seal())
+		}
+	})
+}
+
+func FuzzIndex(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed[1], uint64(0), false)
+		f.Add(seed[1], uint64(7), true)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte, offset uint64, readOnly bool) {
+		config := fuzzConfig()
+		if readOnly {
+			config.WithReadOnly()
+		}
+		writeFuzzFile(t, config.files(), "index", data)
+		file, err := config.files().OpenFile("index", os.O_RDWR|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		idx, err := newIndex(file, *config, newHeader(0, *config))
+		if err != nil {
+			requireTyped(t, err)
+			return
+		}
+
+		n := idx.len()
+		for _, i := range []int64{-1, 0, int64(offset % (n + 1))} {
+			if _, _, err := idx.Read(i); err != nil {
+				requireTyped(t, err)
+			}
+		}
+		if _, _, err := idx.Search(offset); err != nil {
+			requireTyped(t, err)
+		}
+		if !readOnly {
+			if err := idx.Write(offset, headerWidth); err != nil {
+				requireTyped(t, err)
+			} else {
+				n++
+				got, pos, err := idx.Read(-1)
+				require.NoError(t, err)
+				require.Equal(t, offset, got)
+				require.Equal(t, uint64(headerWidth), pos)
+			}
+		}
+		require.NoError(t, idx.Close())
+		require.Equal(t, n, idx.len())
+	})
+}
+
+func FuzzSegment(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed[0], seed[1], []byte{1, 5, 0, 40, 3, 9, 2, 13})
+	}
+	f.Add([]byte(nil), []byte(nil), []byte{0, 4, 8, 1, 5, 9, 3, 13, 2, 17})
+
+	// ops are a sequence of operations on the segment, each byte an operation in its two lowest bits and an argument
+	// in the others: append a record, read an offset, seal the segment, or close and open it again
+	f.Fuzz(func(t *testing.T, store, index, ops []byte) {
+		config := fuzzConfig()
+		writeFuzzFile(t, config.files(), segmentPath("seg", 0, "store"), store)
+		writeFuzzFile(t, config.files(), segmentPath("seg", 0, "index"), index)
+		s, err := newSegment("seg", 0, *config)
+		if err != nil {
+			requireTyped(t, err)
+			return
+		}
+		defer func() { _ = s.Close() }()
+
+		// the values of the records appended to a new segment, which must be read back
+		fresh := len(store) == 0 && len(index) == 0
+		appended := make(map[uint64][]byte)
+		sealed := false
+		for _, op := range ops {
+			arg := uint64(op >> 2)
+			switch op & 3 {
+			case 0:
+				if sealed {
+					continue
+				}
+				value := bytes.Repeat([]byte{op}, int(arg)+1)
+				offset, err := s.Append(&api.Record{Value: value})
+				if err != nil {
+					requireTyped(t, err)
+					continue
+				}
+				require.Equal(t, offset+1, s.nextOffset.Load())
+				appended[offset] = value
+			case 1:
+				// odd arguments count from the base offset, even ones back from the next offset
+				offset := s.baseOffset + arg>>1
+				if arg&1 == 0 {
+					offset = s.nextOffset.Load() - 1 - arg>>1
+				}
+				record, err := s.Read(offset)
+				if err != nil {
+					requireTyped(t, err)
+					_, ok := appended[offset]
+					require.False(t, fresh && ok, "appended record %d: %v", offset, err)
+					continue
+				}
+				require.Equal(t, offset, record.Offset)
+				if value, ok := appended[offset]; ok && fresh {
+					require.Equal(t, value, record.Value)
+				}
+			case 2:
+				require.NoError(t, s.Seal())
+				sealed = true
+			case 3:
+				require.NoError(t, s.Close())
+				// a segment that was opened can be opened again, with the records appended since
+				next := s.nextOffset.Load()
+				s, err = newSegment("seg", 0, *config)
+				require.NoError(t, err)
+				require.Equal(t, next, s.nextOffset.Load())
+				sealed = false
+			}
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+)
+
+// SegmentFormat is the on-disk format version of a segment.
+type SegmentFormat uint16
+
+const (
+	// SegmentFormatV1 indexes records with 4-byte relative offsets, which limits a segment to 2^32 records. Segment
+	// files written before format versions were introduced carry no header and are read as SegmentFormatV1.
+	SegmentFormatV1 SegmentFormat = 1
+	// SegmentFormatV2 indexes records with 8-byte relative offsets.
+	SegmentFormatV2 SegmentFormat = 2
+)
+
+// supported reports whether the format version is known to this version of the package.
+func (f SegmentFormat) supported() bool {
+	return f == SegmentFormatV1 || f == SegmentFormatV2
+}
+
+// offsetWidth returns the number of bytes used to encode a relative offset in an index entry.
+func (f SegmentFormat) offsetWidth() uint64 {
+	if f == SegmentFormatV1 {
+		return 4
+	}
+	return 8
+}
+
+// maxOffset returns the largest relative offset an index entry can hold.
+func (f SegmentFormat) maxOffset() uint64 {
+	if f == SegmentFormatV1 {
+		return math.MaxUint32
+	}
+	return math.MaxUint64
+}
+
+// headerWidth is the size of the header at the start of a segment file.
+const headerWidth = 32
+
+var (
+	// storeMagic identifies a store file. Read as the length prefix of a headerless store's first record it would
+	// claim a record of several exabytes, so it never matches a legacy store.
+	storeMagic = [8]byte{'P', 'L', 'G', 'S', 'T', 'O', 'R', 'E'}
+	// indexMagic identifies an index file. A headerless index starts with the 4-byte offset 0, so it never matches.
+	indexMagic = [8]byte{'P', 'L', 'G', 'I', 'N', 'D', 'E', 'X'}
+)
+
+// header is the fixed size header at the start of the store and index files of a segment. It identifies the file, the
+// format version of its contents and the segment it belongs to. Both files of a segment carry the same header, only
+// the magic bytes differ.
+//
+// 0         8         10        12         16            24            32 bytes
+// +---------+---------+---------+----------+-------------+-------------+
+// |  Magic  | Version |  Flags  | Reserved | Base Offset | Created At  |
+// +---------+---------+---------+----------+-------------+-------------+
+// | [8]byte | uint16  | uint16  |  uint32  |   uint64    | int64 (ns)  |
+// +---------+---------+---------+----------+-------------+-------------+
+type header struct {
+	// version is the format version of the segment.
+	version SegmentFormat
+	// flags describe the codec of the records in the segment. No codec is defined yet, so flags must be 0.
+	flags uint16
+	// baseOffset is the base offset of the segment.
+	baseOffset uint64
+	// createdAt is the time the segment was created.
+	createdAt time.Time
+}
+
+// newHeader returns the header of a new segment starting at the given base offset.
+func newHeader(baseOffset uint64, c Config) header {
+	return header{
+		version:    c.segment.format,
+		baseOffset: baseOffset,
+		createdAt:  c.clock(),
+	}
+}
+
+// encode writes the header with the given magic to the first headerWidth bytes of p.
+func (h header) encode(p []byte, magic [8]byte) {
+	clear(p[:headerWidth])
+	copy(p[0:8], magic[:])
+	byteOrder.PutUint16(p[8:10], uint16(h.version))
+	byteOrder.PutUint16(p[10:12], h.flags)
+	byteOrder.PutUint64(p[16:24], h.baseOffset)
+	byteOrder.PutUint64(p[24:32], uint64(h.createdAt.UnixNano()))
+}
+
+// decodeHeader reads a header with the given magic from p. It reports false if p does not start with the magic.
+func decodeHeader(p []byte, magic [8]byte) (header, bool) {
+	if len(p) < headerWidth || !bytes.Equal(p[0:8], magic[:]) {
+		return header{}, false
+	}
+	return header{
+		version:    SegmentFormat(byteOrder.Uint16(p[8:10])),
+		flags:      byteOrder.Uint16(p[10:12]),
+		baseOffset: byteOrder.Uint64(p[16:24]),
+		createdAt:  time.Unix(0, int64(byteOrder.Uint64(p[24:32]))),
+	}, true
+}
+
+// validate checks that the header describes a segment this package can read at the given base offset.
+func (h header) validate(baseOffset uint64) error {
+	if !h.version.supported() {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedFormat, h.version)
+	}
+	if h.flags != 0 {
+		return fmt.Errorf("%w: unknown codec flags %#x", ErrInvalidSegment, h.flags)
+	}
+	if h.baseOffset != baseOffset {
+		return fmt.Errorf("%w: base offset %d in header, expected %d", ErrInvalidSegment, h.baseOffset, baseOffset)
+	}
+	return nil
+}
+
+// equal reports whether both headers describe the same segment.
+func (h header) equal(o header) bool {
+	return h.version == o.version &&
+		h.flags == o.flags &&
+		h.baseOffset == o.baseOffset &&
+		h.createdAt.Equal(o.createdAt)
+}
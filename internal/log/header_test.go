@@ -0,0 +1,47 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeader(t *testing.T) {
+	want := header{
+		version:    SegmentFormatV2,
+		baseOffset: 42,
+		createdAt:  time.Unix(1700000000, 123),
+	}
+
+	p := make([]byte, headerWidth)
+	want.encode(p, storeMagic)
+
+	got, ok := decodeHeader(p, storeMagic)
+	require.True(t, ok)
+	assert.True(t, want.equal(got))
+	assert.NoError(t, got.validate(42))
+
+	// the magic identifies the kind of file
+	_, ok = decodeHeader(p, indexMagic)
+	assert.False(t, ok)
+	// short input is not a header
+	_, ok = decodeHeader(p[:headerWidth-1], storeMagic)
+	assert.False(t, ok)
+}
+
+func TestHeaderValidate(t *testing.T) {
+	h := header{version: SegmentFormatV1, baseOffset: 16}
+
+	assert.NoError(t, h.validate(16))
+	assert.ErrorIs(t, h.validate(0), ErrInvalidSegment)
+
+	unknownCodec := h
+	unknownCodec.flags = 1
+	assert.ErrorIs(t, unknownCodec.validate(16), ErrInvalidSegment)
+
+	unknownVersion := h
+	unknownVersion.version = 42
+	assert.ErrorIs(t, unknownVersion.validate(16), ErrUnsupportedFormat)
+}
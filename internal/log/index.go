@@ -2,20 +2,24 @@ package log
 
 import (
 	"io"
-	"os"
-
-	"github.com/tysonmote/gommap"
+	"sort"
+	"sync/atomic"
 )
 
 var (
-	offsetWidth   uint64 = 4
 	positionWidth uint64 = 8
-	entryWidth           = offsetWidth + positionWidth
 )
 
+// indexGrowBytes is the size of the chunks the index file grows by as entries are written. A large index grows by a
+// quarter of its size instead, so that it is only remapped a few times.
+const indexGrowBytes = 64 * 1024
+
 // Offset: the offset of current record relative to the segment's base offset
 // Position: the *absolute position* of current record in the store file
 //
+// The width of the offset depends on the segment format version: SegmentFormatV1 uses 4 bytes, SegmentFormatV2 uses
+// 8 bytes. Entries follow the file header, headerless (legacy) index files hold SegmentFormatV1 entries only.
+//
 // 0          4 bytes                     12 bytes
 // +----------+---------------------------+
 // |  Offset  |         Position          |
@@ -26,104 +30,291 @@ var (
 // |<-------- entryWidth (12B) ---------->|
 type index struct {
 	// file is the underlying file handle used for the index.
-	file *os.File
-	// mmap is the memory-mapped representation of the index file.
-	mmap gommap.MMap
-	// size is the actual size of the index in bytes and tells us where to write the next entry.
-	size uint64
+	file file
+	// fs is the filesystem of the file.
+	fs filesystem
+	// mmap is the memory-mapped representation of the index file. A writable index remaps the file as it grows, and
+	// publishes the new mapping atomically for lock-free readers, which load it after the size.
+	mmap atomic.Pointer[[]byte]
+	// retired holds the mappings replaced by larger ones. Readers may still use them, so they are only unmapped when
+	// the index is closed. Only the writer accesses it.
+	retired [][]byte
+	// maxBytes is the size a writable index grows up to.
+	maxBytes uint64
+	// size is the actual size of the index in bytes and tells us where to write the next entry. It is published
+	// atomically after an entry is written, so that readers never see a partially written entry.
+	size atomic.Uint64
+	// header is the header of the index file. Legacy index files have none, their header only holds the version.
+	header header
+	// format is the format version of the index entries.
+	format SegmentFormat
+	// start is the position of the first entry, i.e. the size of the header, or 0 for a legacy index.
+	start uint64
+	// offsetWidth is the number of bytes used to encode the relative offset of an entry.
+	offsetWidth uint64
+	// entryWidth is the size of an entry in bytes.
+	entryWidth uint64
+	// readOnly reports whether the index is mapped read-only.
+	readOnly bool
 }
 
-// newIndex creates a new index for the given file.
-func newIndex(f *os.File, c Config) (*index, error) {
+// newIndex creates a new index for the given file. A new index is written with the given header, an existing index
+// keeps the header (and thereby the format version) it was created with.
+func newIndex(f file, c Config, h header) (*index, error) {
 	idx := &index{
-		file: f,
+		file:     f,
+		fs:       c.files(),
+		maxBytes: c.segment.maxIndexBytes,
 	}
+	idx.mmap.Store(new([]byte))
 
-	info, err := os.Stat(f.Name())
+	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	idx.size = uint64(info.Size())
+	size := uint64(info.Size())
 
-	// preset the file size since mmap can't enlarge the file during the mapping
-	if err = os.Truncate(f.Name(), int64(c.segment.maxIndexBytes)); err != nil {
-		return nil, err
+	if c.readOnly {
+		if size == 0 {
+			// an empty legacy index, there is nothing to map
+			idx.setFormat(header{version: SegmentFormatV1}, 0)
+			return idx, nil
+		}
+	} else {
+		// mmap can't enlarge the file, so the file is grown in chunks ahead of the entries written to the mapping
+		if err = f.Truncate(int64(growth(max(size, headerWidth), c.segment.maxIndexBytes))); err != nil {
+			return nil, err
+		}
 	}
 
-	if idx.mmap, err = gommap.Map(
-		idx.file.Fd(),
-		gommap.PROT_READ|gommap.PROT_WRITE, // grant read and write permissions
-		gommap.MAP_SHARED,                  // changes will be shared with other processes
-	); err != nil {
+	// a shared mapping of the whole file, changes are visible to other processes
+	m, err := idx.fs.Map(f, -1, !c.readOnly)
+	if err != nil {
 		return nil, err
 	}
+	idx.mmap.Store(&m)
 
+	if size == 0 {
+		// a new index, write the header
+		if uint64(len(m)) < headerWidth {
+			_ = idx.fs.Unmap(m)
+			return nil, io.EOF
+		}
+		h.encode(m, indexMagic)
+		idx.setFormat(h, headerWidth)
+		idx.size.Store(headerWidth)
+	} else {
+		size = min(size, uint64(len(m)))
+		if h, ok := decodeHeader(m[:size], indexMagic); ok {
+			idx.setFormat(h, headerWidth)
+		} else {
+			// a legacy index without header
+			idx.setFormat(header{version: SegmentFormatV1}, 0)
+		}
+		idx.size.Store(idx.start + idx.used(size)*idx.entryWidth)
+	}
+
+	if !idx.format.supported() {
+		_ = idx.fs.Unmap(m)
+		return nil, ErrUnsupportedFormat
+	}
+
+	idx.readOnly = c.readOnly
 	return idx, nil
 }
 
+// growth returns the file size for an index of the given size: rounded up to a whole chunk, but no larger than the
+// maximum size of the index.
+func growth(size, maxBytes uint64) uint64 {
+	return min((size+indexGrowBytes-1)/indexGrowBytes*indexGrowBytes, maxBytes)
+}
+
+// setFormat sets the header of the index and derives the layout of its entries.
+func (i *index) setFormat(h header, start uint64) {
+	i.header = h
+	i.format = h.version
+	i.start = start
+	i.offsetWidth = i.format.offsetWidth()
+	i.entryWidth = i.offsetWidth + positionWidth
+}
+
+// used returns the number of entries in use in an existing index file of the given size. The file is larger than its entries if it was
+// not closed properly, or is being written by another process, as the file grows in chunks of zeros. No entry but
+// the first one of a legacy index refers to position 0 of the store (a store header or the first record precedes it),
+// so the entries in use are followed by the first entry that does.
+func (i *index) used(size uint64) uint64 {
+	n := (size - i.start) / i.entryWidth
+	first := 0
+	if i.start == 0 {
+		first = 1 // the first record of a legacy store is at position 0
+	}
+	return uint64(sort.Search(int(n), func(j int) bool {
+		if j < first {
+			return false
+		}
+		_, pos := i.entry(uint64(j))
+		return pos == 0
+	}))
+}
+
+// truncate drops the entries from the n-th on. A writable index zeroes them, so that they are not taken for entries in
+// use when the file is opened again.
+func (i *index) truncate(n uint64) {
+	size := i.start + n*i.entryWidth
+	if size >= i.size.Load() {
+		return
+	}
+	if !i.readOnly {
+		clear((*i.mmap.Load())[size:i.size.Load()])
+	}
+	i.size.Store(size)
+}
+
 // Close ensures that all changes to the memory-mapped file are synchronized and releases all resources.
 func (i *index) Close() error {
-	if err := i.mmap.Sync(gommap.MS_SYNC); err != nil {
+	m := *i.mmap.Load()
+	if i.readOnly {
+		if len(m) > 0 {
+			if err := i.fs.Unmap(m); err != nil {
+				return err
+			}
+		}
+		return i.file.Close()
+	}
+
+	if err := i.fs.SyncMap(m); err != nil {
 		return err
 	}
 	if err := i.file.Sync(); err != nil {
 		return err
 	}
 	// Truncate the file to the size of the index to remove any unused space.
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(i.size.Load())); err != nil {
 		return err
 	}
-	if err := i.mmap.UnsafeUnmap(); err != nil {
-		return err
+	for _, m := range append(i.retired, m) {
+		if err := i.fs.Unmap(m); err != nil {
+			return err
+		}
 	}
 	return i.file.Close()
 }
 
 // Read takes an index and returns the corresponding de-surged offset and absolute position in the store file.
 // If idx is -1, it reads the last entry in the index and returns its actually offset.
-// The type of index is int64 on purpose to allow -1 as a special value and cover the full range of uint32.
-func (i *index) Read(idx int64) (uint32, uint64, error) {
-	if i.size == 0 {
+// The type of index is int64 on purpose to allow -1 as a special value.
+func (i *index) Read(idx int64) (uint64, uint64, error) {
+	n := i.len()
+	if n == 0 {
 		return 0, 0, io.EOF
 	}
 
 	// if idx is -1, read the last entry
 	if idx == -1 {
-		idx = int64((i.size / entryWidth) - 1)
+		idx = int64(n - 1)
 	}
 
-	idxLocation := uint64(idx) * entryWidth
-	if i.size < idxLocation+entryWidth {
+	if uint64(idx) >= n {
 		return 0, 0, io.EOF
 	}
 
-	offset := byteOrder.Uint32(i.mmap[idxLocation : idxLocation+offsetWidth])
-	position := byteOrder.Uint64(i.mmap[idxLocation+offsetWidth : idxLocation+entryWidth])
+	offset, position := i.entry(uint64(idx))
 	return offset, position, nil
 }
 
+// Search returns the last entry whose offset is less than or equal to the given relative offset. Entries are written
+// in increasing offset order, so the index can be binary searched even if it does not hold an entry for every
+// record (see Config.WithSegmentIndexIntervalBytes).
+func (i *index) Search(offset uint64) (uint64, uint64, error) {
+	// j is the first entry whose offset is beyond the requested one
+	j := sort.Search(int(i.len()), func(j int) bool {
+		off, _ := i.entry(uint64(j))
+		return off > offset
+	})
+	if j == 0 {
+		return 0, 0, io.EOF
+	}
+
+	off, pos := i.entry(uint64(j - 1))
+	return off, pos, nil
+}
+
+// len returns the number of entries in the index.
+func (i *index) len() uint64 {
+	return (i.size.Load() - i.start) / i.entryWidth
+}
+
+// entry decodes the n-th entry of the index. The caller must ensure that the entry is within the size of the index,
+// loaded before the mapping is: a mapping loaded after the size covers it.
+func (i *index) entry(n uint64) (uint64, uint64) {
+	m := *i.mmap.Load()
+	loc := i.start + n*i.entryWidth
+	var offset uint64
+	if i.offsetWidth == 4 {
+		offset = uint64(byteOrder.Uint32(m[loc : loc+i.offsetWidth]))
+	} else {
+		offset = byteOrder.Uint64(m[loc : loc+i.offsetWidth])
+	}
+	position := byteOrder.Uint64(m[loc+i.offsetWidth : loc+i.entryWidth])
+	return offset, position
+}
+
 // Write appends a new offset and position entry to the index.
-func (i *index) Write(offset uint32, pos uint64) error {
+func (i *index) Write(offset uint64, pos uint64) error {
+	if offset > i.format.maxOffset() {
+		return ErrOffsetOverflow
+	}
+
 	// check if there is enough space to write a new entry
-	if uint64(len(i.mmap)) < i.size+entryWidth {
+	size := i.size.Load()
+	if i.readOnly || i.maxBytes < size+i.entryWidth {
 		return io.EOF
 	}
+	m := *i.mmap.Load()
+	if uint64(len(m)) < size+i.entryWidth {
+		var err error
+		if m, err = i.grow(size + i.entryWidth); err != nil {
+			return err
+		}
+	}
 
 	// encode offset
-	byteOrder.PutUint32(i.mmap[i.size:i.size+offsetWidth], offset)
+	if i.offsetWidth == 4 {
+		byteOrder.PutUint32(m[size:size+i.offsetWidth], uint32(offset))
+	} else {
+		byteOrder.PutUint64(m[size:size+i.offsetWidth], offset)
+	}
 	// encode position
-	byteOrder.PutUint64(i.mmap[i.size+offsetWidth:i.size+entryWidth], pos)
+	byteOrder.PutUint64(m[size+i.offsetWidth:size+i.entryWidth], pos)
 
-	i.size += entryWidth
+	i.size.Store(size + i.entryWidth)
 
 	return nil
 }
 
+// grow enlarges the index file to hold at least size bytes, by a chunk or a quarter of its size, and remaps it. The new
+// mapping is published before any entry is written to it, and the one it replaces is kept until the index is closed.
+func (i *index) grow(size uint64) ([]byte, error) {
+	old := *i.mmap.Load()
+	capacity := growth(max(size, uint64(len(old))+uint64(len(old))/4), i.maxBytes)
+	// mmap can't enlarge the file, the file is grown first
+	if err := i.file.Truncate(int64(capacity)); err != nil {
+		return nil, err
+	}
+	m, err := i.fs.Map(i.file, int64(capacity), true)
+	if err != nil {
+		return nil, err
+	}
+	i.retired = append(i.retired, old)
+	i.mmap.Store(&m)
+	return m, nil
+}
+
 // Remove closes the index and removes the underlying file from disk.
 func (i *index) Remove() error {
 	if err := i.Close(); err != nil {
 		return err
 	}
-	return os.Remove(i.file.Name())
+	return i.fs.Remove(i.file.Name())
 }
@@ -1,7 +1,11 @@
 package log
 
 import (
+	"io"
+	"math"
 	"os"
+	"path"
+	"sync"
 	"testing"
 
 	"github.com/docker/go-units"
@@ -18,7 +22,7 @@ func TestIndex(t *testing.T) {
 	defer os.Remove(f.Name())
 
 	// create a new index
-	index, err := newIndex(f, *config)
+	index, err := newIndex(f, *config, newHeader(0, *config))
 	require.NoError(t, err)
 	defer index.Close()
 
@@ -28,7 +32,7 @@ func TestIndex(t *testing.T) {
 
 	// write some entries
 	var entries = []struct {
-		offset   uint32
+		offset   uint64
 		position uint64
 	}{
 		{offset: 0, position: 0},
@@ -63,7 +67,7 @@ func TestIndex(t *testing.T) {
 	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0600)
 	require.NoError(t, err)
 
-	index, err = newIndex(f, *config)
+	index, err = newIndex(f, *config, newHeader(0, *config))
 	require.NoError(t, err)
 	defer index.Close()
 
@@ -82,7 +86,7 @@ func TestIndexRemove(t *testing.T) {
 	require.NoError(t, err)
 
 	// create a new index
-	index, err := newIndex(f, *config)
+	index, err := newIndex(f, *config, newHeader(0, *config))
 	require.NoError(t, err)
 
 	// write some entries
@@ -100,3 +104,252 @@ func TestIndexRemove(t *testing.T) {
 	_, err = os.Stat(filename)
 	require.ErrorIs(t, err, os.ErrNotExist)
 }
+
+func TestIndexSearch(t *testing.T) {
+	config := NewConfig().WithSegmentMaxIndexBytes(10 * units.MiB)
+
+	f, err := os.CreateTemp(os.TempDir(), "index_search_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	index, err := newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer index.Close()
+
+	// searching an empty index gives an error
+	_, _, err = index.Search(0)
+	require.ErrorIs(t, err, io.EOF)
+
+	// a sparse index holding every 10th record
+	for off := uint64(0); off < 100; off += 10 {
+		err = index.Write(off, off*100)
+		require.NoError(t, err)
+	}
+
+	for off := uint64(0); off < 120; off++ {
+		want := min(off/10*10, 90)
+		gotOffset, gotPosition, err := index.Search(off)
+		assert.NoError(t, err)
+		assert.Equal(t, want, gotOffset)
+		assert.Equal(t, want*100, gotPosition)
+	}
+}
+
+func TestIndexFormat(t *testing.T) {
+	v1 := NewConfig().WithSegmentMaxIndexBytes(1 * units.MiB)
+	v2 := NewConfig().WithSegmentMaxIndexBytes(1 * units.MiB).WithSegmentFormat(SegmentFormatV2)
+
+	dir := t.TempDir()
+	open := func(name string, c *Config) *index {
+		f, err := os.OpenFile(path.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644)
+		require.NoError(t, err)
+		idx, err := newIndex(f, *c, newHeader(0, *c))
+		require.NoError(t, err)
+		return idx
+	}
+
+	// 4-byte offsets can't hold offsets beyond uint32
+	idx := open("v1.index", v1)
+	assert.Equal(t, SegmentFormatV1, idx.format)
+	err := idx.Write(math.MaxUint32, 0)
+	require.NoError(t, err)
+	err = idx.Write(math.MaxUint32+1, 1)
+	require.ErrorIs(t, err, ErrOffsetOverflow)
+	require.NoError(t, idx.Close())
+
+	// 8-byte offsets can
+	idx = open("v2.index", v2)
+	assert.Equal(t, SegmentFormatV2, idx.format)
+	err = idx.Write(math.MaxUint32+1, 100)
+	require.NoError(t, err)
+	require.NoError(t, idx.Close())
+
+	// the format version of an existing index wins over the config
+	idx = open("v2.index", v1)
+	defer idx.Close()
+	assert.Equal(t, SegmentFormatV2, idx.format)
+	off, pos, err := idx.Read(-1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(math.MaxUint32+1), off)
+	assert.Equal(t, uint64(100), pos)
+}
+
+func TestIndexLegacy(t *testing.T) {
+	config := NewConfig().WithSegmentMaxIndexBytes(1 * units.MiB).WithSegmentFormat(SegmentFormatV2)
+
+	// an index written before headers were introduced
+	f, err := os.CreateTemp(os.TempDir(), "index_legacy_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	legacy := make([]byte, 3*12)
+	for i := uint32(0); i < 3; i++ {
+		byteOrder.PutUint32(legacy[i*12:], i)
+		byteOrder.PutUint64(legacy[i*12+4:], uint64(i)*100)
+	}
+	_, err = f.Write(legacy)
+	require.NoError(t, err)
+
+	index, err := newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer index.Close()
+
+	assert.Equal(t, SegmentFormatV1, index.format)
+	assert.Equal(t, uint64(3), index.len())
+	for i := uint64(0); i < 3; i++ {
+		off, pos, err := index.Read(int64(i))
+		assert.NoError(t, err)
+		assert.Equal(t, i, off)
+		assert.Equal(t, i*100, pos)
+	}
+}
+
+func TestIndexUnclosed(t *testing.T) {
+	config := NewConfig().WithSegmentMaxIndexBytes(1 * units.MiB)
+
+	f, err := os.CreateTemp(os.TempDir(), "index_unclosed_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	index, err := newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	for off := uint64(0); off < 3; off++ {
+		err = index.Write(off, headerWidth+off*100)
+		require.NoError(t, err)
+	}
+
+	// the index file still has the size of its first chunk, as if the process crashed
+	info, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(indexGrowBytes), info.Size())
+
+	// the zero padding is not mistaken for entries
+	other, err := os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	reopened, err := newIndex(other, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	assert.Equal(t, uint64(3), reopened.len())
+	off, pos, err := reopened.Read(-1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), off)
+	assert.Equal(t, uint64(headerWidth+200), pos)
+
+	require.NoError(t, index.fs.Unmap(*index.mmap.Load()))
+	require.NoError(t, index.file.Close())
+}
+
+func TestIndexGrow(t *testing.T) {
+	config := NewConfig().WithSegmentMaxIndexBytes(1 * units.MiB)
+
+	f, err := os.CreateTemp(t.TempDir(), "index_grow_test")
+	require.NoError(t, err)
+
+	index, err := newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+
+	size := func() int64 {
+		info, err := os.Stat(f.Name())
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	// a new index only takes its first chunk on disk, and only maps it
+	require.Equal(t, int64(indexGrowBytes), size())
+	first := *index.mmap.Load()
+	require.Len(t, first, indexGrowBytes)
+
+	// the file grows chunk by chunk as entries are written
+	n := uint64(2*indexGrowBytes) / index.entryWidth
+	for off := uint64(0); off < n; off++ {
+		require.NoError(t, index.Write(off, headerWidth+off*100))
+	}
+	require.Equal(t, int64(3*indexGrowBytes), size())
+	require.Len(t, *index.mmap.Load(), 3*indexGrowBytes)
+
+	// the replaced mapping stays valid for the readers that still use it
+	assert.Equal(t, uint64(headerWidth), byteOrder.Uint64(first[headerWidth+index.offsetWidth:]))
+
+	// entries written before and after growing are readable
+	for _, off := range []uint64{0, n / 2, n - 1} {
+		got, pos, err := index.Read(int64(off))
+		assert.NoError(t, err)
+		assert.Equal(t, off, got)
+		assert.Equal(t, headerWidth+off*100, pos)
+	}
+
+	// the file is shrunk to its content on close
+	require.NoError(t, index.Close())
+	require.Equal(t, int64(headerWidth+n*index.entryWidth), size())
+
+	// and grows to a whole chunk again when reopened
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	index, err = newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer index.Close()
+
+	require.Equal(t, int64(3*indexGrowBytes), size())
+	assert.Equal(t, n, index.len())
+}
+
+func TestIndexGrowConcurrentReads(t *testing.T) {
+	config := NewConfig().WithSegmentMaxIndexBytes(1 * units.MiB)
+
+	f, err := os.CreateTemp(t.TempDir(), "index_grow_reads_test")
+	require.NoError(t, err)
+	index, err := newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer index.Close()
+
+	// readers never see an entry outside the mapping they load while the writer remaps the index
+	n := uint64(4*indexGrowBytes) / index.entryWidth
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				off, pos, err := index.Read(-1)
+				if err == nil {
+					assert.Equal(t, headerWidth+off*100, pos)
+				}
+			}
+		}()
+	}
+	for off := uint64(0); off < n; off++ {
+		require.NoError(t, index.Write(off, headerWidth+off*100))
+	}
+	close(done)
+	wg.Wait()
+	assert.Equal(t, n, index.len())
+}
+
+func TestIndexGrowLimit(t *testing.T) {
+	// a maximum size below a chunk is never exceeded
+	config := NewConfig().WithSegmentMaxIndexBytes(1024)
+
+	f, err := os.CreateTemp(t.TempDir(), "index_grow_limit_test")
+	require.NoError(t, err)
+
+	index, err := newIndex(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer index.Close()
+
+	info, err := os.Stat(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(1024), info.Size())
+
+	var off uint64
+	for ; index.Write(off, headerWidth+off*100) == nil; off++ {
+	}
+	assert.Equal(t, (1024-headerWidth)/index.entryWidth, off)
+	assert.ErrorIs(t, index.Write(off, headerWidth+off*100), io.EOF)
+}
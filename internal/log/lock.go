@@ -0,0 +1,33 @@
+//go:build !windows
+
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockName is the name of the lock file in the log directory.
+const lockName = "LOCK"
+
+// lockDir takes an exclusive lock on the log directory, so that no other process (or other Log in this process)
+// opens it for writing. The lock is held until the returned file is closed, and released by the kernel if the process
+// dies. The lock file itself is never removed, removing it would let two processes lock different files.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(path.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// flock locks belong to the open file description, so a second open in the same process conflicts as well
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLogLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,42 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+)
+
+const (
+	// lockName is the name of the lock file in the log directory.
+	lockName = "LOCK"
+	// errorSharingViolation is ERROR_SHARING_VIOLATION, which the syscall package does not define.
+	errorSharingViolation syscall.Errno = 32
+)
+
+// lockDir takes an exclusive lock on the log directory, so that no other process (or other Log in this process)
+// opens it for writing. On Windows, the lock file is opened without sharing, so any other open of it fails until
+// the returned file is closed.
+func lockDir(dir string) (*os.File, error) {
+	name := path.Join(dir, lockName)
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := syscall.CreateFile(p,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0, // no sharing
+		nil,
+		syscall.OPEN_ALWAYS,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0,
+	)
+	if err != nil {
+		if errors.Is(err, errorSharingViolation) {
+			return nil, ErrLogLocked
+		}
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), name), nil
+}
@@ -1,83 +1,355 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/Devin-Yeung/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
 	ErrOffsetOutOfRange = fmt.Errorf("offset out of range")
 	ErrSegmentActive    = fmt.Errorf("cannot truncate active segment")
+	// ErrSegmentFull is returned when appending to a segment that holds the maximum number of records.
+	ErrSegmentFull = fmt.Errorf("segment is full")
+	// ErrOffsetOverflow is returned when a relative offset does not fit into the index entry layout.
+	ErrOffsetOverflow = fmt.Errorf("relative offset overflows index entry")
+	// ErrUnsupportedFormat is returned when a segment file has a format version unknown to this package.
+	ErrUnsupportedFormat = fmt.Errorf("unsupported segment format version")
+	// ErrInvalidSegment is returned when the files of a segment do not belong to it or to each other.
+	ErrInvalidSegment = fmt.Errorf("invalid segment")
+	// ErrInvalidManifest is returned when the manifest of the log directory cannot be parsed.
+	ErrInvalidManifest = fmt.Errorf("invalid manifest")
+	// ErrMissingSegment is returned when files of a segment listed in the manifest are missing.
+	ErrMissingSegment = fmt.Errorf("missing segment files")
+	// ErrLogLocked is returned when the log directory is opened for writing by another process or Log.
+	ErrLogLocked = fmt.Errorf("log directory is locked by another writer")
+	// ErrReadOnly is returned when modifying a log opened in read-only mode.
+	ErrReadOnly = fmt.Errorf("log is read-only")
+	// ErrRecordTooLarge is returned when appending a record larger than the configured maximum record size, or reading
+	// a record whose length prefix exceeds it.
+	ErrRecordTooLarge = fmt.Errorf("record too large")
+	// ErrOffsetConflict is returned by a conditional append when the log does not end at the expected offset. The
+	// error is an *OffsetConflictError holding the actual next offset.
+	ErrOffsetConflict = fmt.Errorf("offset conflict")
+	// ErrStaleSequence is returned when an idempotent producer appends a record with a sequence number older than its
+	// last appended one.
+	ErrStaleSequence = fmt.Errorf("stale sequence number")
 )
 
+// OffsetConflictError is returned by AppendIfNextOffset when the next offset of the log is not the expected one, i.e.
+// another writer appended in the meantime. It matches ErrOffsetConflict.
+type OffsetConflictError struct {
+	// Expected is the next offset the caller expected.
+	Expected uint64
+	// Actual is the next offset of the log.
+	Actual uint64
+}
+
+func (e *OffsetConflictError) Error() string {
+	return fmt.Sprintf("%v: expected next offset %d, but the log ends at %d", ErrOffsetConflict, e.Expected, e.Actual)
+}
+
+func (e *OffsetConflictError) Unwrap() error {
+	return ErrOffsetConflict
+}
+
+// Log is a segmented, append-only log.
+//
+// Writers (Append, Truncate, Close) are serialized by a mutex. Readers take no lock: they find segments in an immutable
+// snapshot of the segment list, read records below the atomically published next offset of a segment, and hold a
+// reference on the segment while reading so that a concurrent truncation can't close its files under them.
 type Log struct {
 	Dir    string
 	Config Config
-	mu     sync.RWMutex
+	mu     mutex
 	// current active segment for appending new records
 	activeSegment *segment
-	// all segments, including active and inactive ones
+	// all segments, including active and inactive ones, only accessed by writers
 	segments []*segment
+	// immutable copy of segments for readers, replaced whenever segments changes
+	snapshot atomic.Pointer[[]*segment]
+	// sealed segments whose files are open
+	cache *segmentCache
+	// segment files found on startup that are not listed in the manifest
+	orphans []string
+	// lock holds the exclusive lock on the directory, nil in read-only mode
+	lock io.Closer
+	// stop stops rolling expired segments in the background, nil if segments don't expire
+	stop func()
+	// staleManifest reports that writing the manifest failed, it doesn't list the current segments
+	staleManifest bool
+	// last record appended by each idempotent producer, only accessed by writers
+	producers producers
+	// open and aborted transactions
+	txns *transactions
 }
 
+// NewLog opens the log in the given directory. Unless the config asks for read-only mode, the directory is locked
+// exclusively until the log is closed, and opening it again fails with ErrLogLocked.
 func NewLog(dir string, c Config) (*Log, error) {
 	l := &Log{
 		Dir:    dir,
 		Config: c,
+		mu:     newMutex(),
+		cache:  newSegmentCache(c.maxOpenSegments),
+	}
+
+	if !c.readOnly {
+		lock, err := c.files().Lock(dir)
+		if err != nil {
+			return nil, err
+		}
+		l.lock = lock
 	}
 
 	if err := l.setup(); err != nil {
+		_ = l.closeSegments()
+		l.unlock()
 		return nil, err
 	}
 
+	if maxAge := c.segment.maxAge; maxAge > 0 && !c.readOnly {
+		// tiny ages would make the ticker spin, or panic at 0
+		l.rollExpired(max(maxAge/2, minRollInterval))
+	}
+
 	return l, nil
 }
 
+// minRollInterval is the shortest interval at which the age of the active segment is checked in the background.
+const minRollInterval = time.Millisecond
+
+// rollExpired starts rolling the active segment in the background, checking its age at the given interval. A log that
+// isn't appended to would otherwise keep its active segment forever. The background roll has nobody to report an error
+// to, it is retried by the next append, which does.
+func (l *Log) rollExpired(interval time.Duration) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				l.mu.Lock()
+				if l.activeSegment.IsExpired() {
+					_ = l.roll()
+				}
+				l.mu.Unlock()
+			}
+		}
+	}()
+
+	var once sync.Once
+	l.stop = func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// unlock releases the directory lock, if held.
+func (l *Log) unlock() {
+	if l.lock != nil {
+		_ = l.lock.Close()
+		l.lock = nil
+	}
+}
+
 func (l *Log) setup() error {
-	files, err := os.ReadDir(l.Dir)
+	files, err := l.Config.files().ReadDir(l.Dir)
 	if err != nil {
 		return err
 	}
-	// retrieve base offsets from segment files
-	var baseOffsets []uint64
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		rawOffset := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		offset, err := strconv.ParseUint(rawOffset, 10, 64)
-		if err != nil {
-			continue // skip files with invalid names
-		}
-		baseOffsets = append(baseOffsets, offset)
+	baseOffsets, ok, err := readManifest(l.Config.files(), l.Dir)
+	if err != nil {
+		return err
+	}
+	if ok {
+		err = l.check(files, baseOffsets)
+	} else if l.Config.readOnly {
+		// a read-only log can neither migrate nor initialize the directory
+		err = fmt.Errorf("%s: %w", path.Join(l.Dir, manifestName), os.ErrNotExist)
+	} else {
+		// without a manifest, the directory is either new or was written before manifests were introduced
+		baseOffsets, err = l.migrate(files)
+	}
+	if err != nil {
+		return err
 	}
 
-	// deduplicate and sort
-	baseOffsets = tidyOffsets(baseOffsets)
-
-	for _, offset := range baseOffsets {
+	// all but the last segment are closed for appends, they are only opened once read
+	for i, offset := range baseOffsets {
+		if i < len(baseOffsets)-1 {
+			l.segments = append(l.segments, newSealedSegment(l.Dir, offset, baseOffsets[i+1], l.Config))
+			continue
+		}
 		if err := l.newSegment(offset); err != nil {
 			return err
 		}
 	}
+	l.publish()
+	if l.Config.readOnly {
+		if len(l.segments) == 0 {
+			return fmt.Errorf("%w: manifest lists no segments", ErrInvalidManifest)
+		}
+		return l.recoverState()
+	}
+
 	// if no segments exist, create the initial segment
 	if len(l.segments) == 0 {
 		if err := l.newSegment(l.Config.segment.initialOffset); err != nil {
 			return err
 		}
 	}
+	if err := l.recoverState(); err != nil {
+		return err
+	}
+	return l.writeManifest()
+}
+
+// recoverState restores the state of the idempotent producers and of the transactions: from the snapshot of the
+// active segment, the state as of its start, and the records of the active segment.
+func (l *Log) recoverState() error {
+	active := l.segments[len(l.segments)-1]
+	var err error
+	if l.producers, l.txns, err = readSnapshot(l.Config.files(), l.Dir, active.baseOffset); err != nil {
+		return err
+	}
+
+	// an empty segment has nothing to replay, scanning it would fail
+	if active.nextOffset.Load() > active.baseOffset {
+		if err := l.cache.acquire(active); err != nil {
+			return err
+		}
+		var decodeErr error
+		err := active.scan(active.baseOffset, func(p []byte) bool {
+			record := &api.Record{}
+			if decodeErr = proto.Unmarshal(p, record); decodeErr != nil {
+				return false
+			}
+			l.producers.observe(record)
+			l.txns.observe(record)
+			return true
+		})
+		_ = active.release()
+		if err == nil {
+			err = decodeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	l.txns.publish()
+	return nil
+}
+
+// check validates the directory against the base offsets listed in the manifest. Every listed segment must have both
+// of its files, segment files that are not listed are orphans, e.g. left behind by a crash during a roll or
+// truncation. Orphans are not opened and can be inspected with Orphans.
+func (l *Log) check(files []os.DirEntry, baseOffsets []uint64) error {
+	live := make(map[uint64]struct{}, len(baseOffsets))
+	for _, offset := range baseOffsets {
+		live[offset] = struct{}{}
+	}
+
+	present := make(map[string]struct{})
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		match := legacySegmentFileName.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue // not a segment file
+		}
+		offset, err := strconv.ParseUint(match[1], 10, 64)
+		if _, ok := live[offset]; err != nil || !ok || !segmentFileName.MatchString(file.Name()) {
+			l.orphans = append(l.orphans, file.Name())
+			continue
+		}
+		present[file.Name()] = struct{}{}
+	}
+
+	var missing []string
+	for _, offset := range baseOffsets {
+		for _, ext := range []string{"store", "index"} {
+			name := path.Base(segmentPath(l.Dir, offset, ext))
+			if _, ok := present[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingSegment, strings.Join(missing, ", "))
+	}
 	return nil
 }
 
+// migrate returns the base offsets of all segment files in a directory without manifest, renaming files written
+// before base offsets were zero-padded.
+func (l *Log) migrate(files []os.DirEntry) ([]uint64, error) {
+	var baseOffsets []uint64
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		match := legacySegmentFileName.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue // skip files with invalid names
+		}
+		offset, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if !segmentFileName.MatchString(file.Name()) {
+			if err := l.Config.files().Rename(path.Join(l.Dir, file.Name()), segmentPath(l.Dir, offset, match[2])); err != nil {
+				return nil, err
+			}
+		}
+		baseOffsets = append(baseOffsets, offset)
+	}
+
+	// deduplicate and sort
+	return tidyOffsets(baseOffsets), nil
+}
+
+// writeManifest records the base offsets of the current segments in the manifest. If that fails, the manifest is
+// stale until it is written again.
+func (l *Log) writeManifest() error {
+	baseOffsets := make([]uint64, len(l.segments))
+	for i, s := range l.segments {
+		baseOffsets[i] = s.baseOffset
+	}
+	err := writeManifest(l.Config.files(), l.Dir, baseOffsets)
+	l.staleManifest = err != nil
+	return err
+}
+
+// Orphans returns the names of segment files found in the directory on startup that are not part of the log.
+func (l *Log) Orphans() []string {
+	return l.orphans
+}
+
 // newSegment creates a new segment and sets it as the active segment.
 func (l *Log) newSegment(baseOffset uint64) error {
 	s, err := newSegment(l.Dir, baseOffset, l.Config)
@@ -87,59 +359,357 @@ func (l *Log) newSegment(baseOffset uint64) error {
 
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
+	l.publish()
+	return nil
+}
+
+// publish makes the current list of segments visible to readers.
+func (l *Log) publish() {
+	segments := slices.Clone(l.segments)
+	l.snapshot.Store(&segments)
+}
+
+// loadSegments returns the latest list of segments published to readers. The list must not be modified.
+func (l *Log) loadSegments() []*segment {
+	if segments := l.snapshot.Load(); segments != nil {
+		return *segments
+	}
 	return nil
 }
 
-// Append adds a new record to the log and returns its index
+// roll replaces the active segment with a new one starting at the next offset of the log. The old segment won't be
+// written anymore, so it is sealed and handed over to the cache of open segments. If the roll fails before the new
+// segment is active, the old one stays active, unsealed.
+func (l *Log) roll() error {
+	sealed := l.activeSegment
+	// the state as of the start of the new segment, so that startup only replays the active segment. Every segment
+	// keeps its snapshot until it is truncated, so that the oldest segment left holds the state of the records before.
+	if err := writeSnapshot(l.Config.files(), l.Dir, sealed.nextOffset.Load(), l.producers, l.txns); err != nil {
+		return err
+	}
+	// files left at the next base offset by a crash while rolling hold no records, the new segment starts over
+	for _, ext := range []string{"store", "index"} {
+		err := l.Config.files().Remove(segmentPath(l.Dir, sealed.nextOffset.Load(), ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	s, err := newSegment(l.Dir, sealed.nextOffset.Load(), l.Config)
+	if err != nil {
+		return err
+	}
+	// sealing maps the store read-only, the segment can't be appended to afterward
+	if err := sealed.Seal(); err != nil {
+		return errors.Join(err, s.Remove())
+	}
+
+	l.segments = append(l.segments, s)
+	l.activeSegment = s
+	l.publish()
+	// a manifest that can't be written is written by the next append
+	return errors.Join(l.writeManifest(), l.cache.add(sealed))
+}
+
+// Append adds a new record to the log and returns its index. A record with a producer id is deduplicated: if its
+// sequence number is the last one appended by its producer, it is not appended again and the offset of the original
+// is returned; older sequence numbers fail with ErrStaleSequence.
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
+	return l.AppendContext(context.Background(), record)
+}
+
+// AppendContext is like Append, but gives up waiting for other writers once the context is done, returning the
+// context's error. Once the record is being written, it is written regardless of the context: abandoning the write
+// would leave the caller unsure whether the record was appended.
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	return l.append(ctx, record, nil)
+}
+
+// AppendIfNextOffset appends the record only if it gets the expected offset, i.e. if the log still ends at expected.
+// Otherwise, it fails with an *OffsetConflictError and leaves the log unchanged. It is meant for optimistic
+// concurrency: a writer reads up to the end of the log, decides what to append, and retries if another writer got
+// there first.
+func (l *Log) AppendIfNextOffset(expected uint64, record *api.Record) (uint64, error) {
+	return l.AppendIfNextOffsetContext(context.Background(), expected, record)
+}
+
+// AppendIfNextOffsetContext is like AppendIfNextOffset, but gives up waiting for other writers like AppendContext.
+func (l *Log) AppendIfNextOffsetContext(ctx context.Context, expected uint64, record *api.Record) (uint64, error) {
+	return l.append(ctx, record, &expected)
+}
+
+// append appends the record, if the log ends at the expected offset unless expected is nil.
+func (l *Log) append(ctx context.Context, record *api.Record, expected *uint64) (uint64, error) {
+	if err := l.mu.LockContext(ctx); err != nil {
+		return 0, err
+	}
 	defer l.mu.Unlock()
 
+	if l.Config.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	// a retried record of an idempotent producer gets the offset it was appended at the first time
+	if offset, duplicate, err := l.producers.check(record); err != nil || duplicate {
+		return offset, err
+	}
+	// the next offset only changes under the lock, so the check holds until the record is appended
+	if next := l.activeSegment.nextOffset.Load(); expected != nil && *expected != next {
+		return 0, &OffsetConflictError{Expected: *expected, Actual: next}
+	}
+
+	return l.write(record)
+}
+
+// write appends the record to the active segment, rolling it when it is too old or full. The caller must hold l.mu.
+func (l *Log) write(record *api.Record) (uint64, error) {
+	// records of a segment missing from the manifest would be lost on restart
+	if l.staleManifest {
+		if err := l.writeManifest(); err != nil {
+			return 0, err
+		}
+	}
+	// the record starts a new segment if the active one is too old, or is still full because rolling it failed
+	if l.activeSegment.IsExpired() || l.activeSegment.IsFull() {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	// readers must know that a transaction is open before they see its first record
+	opened := l.txns.begin(record, l.activeSegment.nextOffset.Load())
 	offset, err := l.activeSegment.Append(record)
 	if err != nil {
+		if opened {
+			l.txns.cancel(record.TransactionId)
+		}
 		return 0, err
 	}
+	l.producers.observe(record)
+	if record.Control != api.Control_CONTROL_NONE {
+		// readers see the end of the transaction once its marker is written
+		l.txns.observe(record)
+		l.txns.publish()
+	}
 
-	// check if active segment is full
+	// check if active segment is full, the record is appended even if the roll fails: the next append retries it
 	if l.activeSegment.IsFull() {
-		err = l.newSegment(l.activeSegment.nextOffset)
-		if err != nil {
-			return 0, err
-		}
+		_ = l.roll()
 	}
 	return offset, nil
 }
 
-// Read retrieves a record by its offset from the log.
+// endTransaction writes the commit or abort marker of a transaction. It does nothing if the transaction has no
+// records in the log, or ended already, so that a coordinator can end transactions again after a crash.
+func (l *Log) endTransaction(ctx context.Context, id uint64, commit bool) error {
+	if err := l.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	defer l.mu.Unlock()
+
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+	if !l.txns.isOpen(id) {
+		return nil
+	}
+
+	marker := &api.Record{TransactionId: id, Control: api.Control_CONTROL_ABORT}
+	if commit {
+		marker.Control = api.Control_CONTROL_COMMIT
+	}
+	_, err := l.write(marker)
+	return err
+}
+
+// flush writes the records buffered by the active segment to its file.
+func (l *Log) flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.activeSegment.Flush()
+}
+
+// openTransactions returns the ids of the transactions that have records in the log but did not end yet.
+func (l *Log) openTransactions() []uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Sorted(maps.Keys(l.txns.open))
+}
+
+// StableOffset returns the last stable offset: the offset of the first record of the oldest open transaction, or the
+// end of the log if no transaction is open. Read-committed consumers only read below it, as the fate of the records
+// from there on is not decided yet.
+func (l *Log) StableOffset() uint64 {
+	// load the end first: a transaction is opened before its first record is visible, so the view loaded afterwards
+	// knows about every transaction with records below the end
+	end := l.end()
+	if v := l.txns.view.Load(); v.open && v.firstOpen < end {
+		return v.firstOpen
+	}
+	return end
+}
+
+// Aborted reports whether the record belongs to an aborted transaction, and must be skipped by read-committed
+// consumers. Records of transactions that are still open are not aborted (yet), see StableOffset.
+func (l *Log) Aborted(record *api.Record) bool {
+	if record.TransactionId == 0 {
+		return false
+	}
+	a, ok := l.txns.view.Load().aborted[record.TransactionId]
+	return ok && a.first <= record.Offset && record.Offset <= a.last
+}
+
+// Read retrieves a record by its offset from the log. It does not wait for writers.
 func (l *Log) Read(offset uint64) (*api.Record, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+	s, err := l.acquire(offset)
+	if err != nil {
+		return nil, err
+	}
+	defer s.release()
 
-	// find the segment that contains the offset
-	var s *segment
-	for _, seg := range l.segments {
-		if seg.baseOffset <= offset && offset < seg.nextOffset {
-			s = seg
-			break
+	return s.Read(offset)
+}
+
+// ReadContext is like Read, but fails with the context's error if the context is done before the read. Reads take no
+// lock, so there is nothing to wait for and the read itself is not interrupted.
+func (l *Log) ReadContext(ctx context.Context, offset uint64) (*api.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return l.Read(offset)
+}
+
+// ReadRange retrieves the contiguous records from the given offset on, up to maxRecords records and maxBytes bytes of
+// encoded records (0 means no limit). The first record is returned even if it exceeds maxBytes, so that a consumer
+// always makes progress. It also returns the offset following the last record returned, to read from next. At the end
+// of the log, it returns no records and the given offset. The records are read sequentially from the store, with a
+// single index lookup per segment.
+func (l *Log) ReadRange(from, maxRecords, maxBytes uint64) ([]*api.Record, uint64, error) {
+	var records []*api.Record
+	var size uint64
+	next := from
+	for full := false; !full; {
+		s, err := l.acquire(next)
+		if errors.Is(err, ErrOffsetOutOfRange) && (len(records) > 0 || next == l.end()) {
+			break // the end of the log, or of what is left of it after a truncation
+		}
+		if err != nil {
+			return nil, from, err
 		}
+
+		var decodeErr error
+		err = s.scan(next, func(p []byte) bool {
+			if maxRecords > 0 && uint64(len(records)) >= maxRecords ||
+				maxBytes > 0 && len(records) > 0 && size+uint64(len(p)) > maxBytes {
+				full = true
+				return false
+			}
+			record := &api.Record{}
+			if decodeErr = proto.Unmarshal(p, record); decodeErr != nil {
+				return false
+			}
+			records = append(records, record)
+			size += uint64(len(p))
+			next++
+			return true
+		})
+		_ = s.release()
+		if err == nil {
+			err = decodeErr
+		}
+		if err != nil {
+			return nil, from, err
+		}
+	}
+	return records, next, nil
+}
+
+// end returns the offset following the last record of the log.
+func (l *Log) end() uint64 {
+	segments := l.loadSegments()
+	if len(segments) == 0 {
+		return 0
+	}
+	return segments[len(segments)-1].nextOffset.Load()
+}
+
+// ReadRaw retrieves the encoded record at the offset without decoding it. Records of closed segments are not copied:
+// the bytes are a view into the memory-mapped segment, which stays mapped until release is called. The bytes must
+// not be modified, nor used after release. release must be called once the bytes are no longer needed, even though
+// records of the active segment are copies.
+func (l *Log) ReadRaw(offset uint64) (p []byte, release func(), err error) {
+	s, err := l.acquire(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p, err = s.ReadRaw(offset); err != nil {
+		_ = s.release()
+		return nil, nil, err
 	}
 
+	var once sync.Once
+	return p, func() { once.Do(func() { _ = s.release() }) }, nil
+}
+
+// acquire returns the segment that contains the offset, with a reference taken for the caller. A sealed segment whose
+// files were closed is opened again, the active one is always open.
+func (l *Log) acquire(offset uint64) (*segment, error) {
+	s := l.segmentFor(offset)
 	if s == nil {
 		return nil, ErrOffsetOutOfRange
 	}
+	// the segment may have been truncated since the snapshot was taken
+	if err := l.cache.acquire(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	return s.Read(offset)
+// segmentFor returns the segment that contains the offset, or nil if no segment does.
+// Segments are kept sorted by base offset, so the owning segment is found by binary search. Segments are not
+// required to be contiguous (truncation or compaction may leave gaps), so the candidate is checked against its
+// right boundary as well.
+func (l *Log) segmentFor(offset uint64) *segment {
+	segments := l.loadSegments()
+	// i is the first segment whose base offset is beyond the offset
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].baseOffset > offset
+	})
+	if i == 0 {
+		return nil
+	}
+
+	s := segments[i-1]
+	if offset >= s.nextOffset.Load() {
+		return nil // offset falls into a gap or beyond the end of the log
+	}
+	return s
 }
 
-// Close closes all segments in the log.
+// Close closes all segments in the log and releases the directory lock. Segments still being read are closed once
+// their readers are done.
 func (l *Log) Close() error {
+	// the background roll takes the lock, stop it first
+	if l.stop != nil {
+		l.stop()
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	for _, s := range l.segments {
-		if err := s.Close(); err != nil {
-			return err
-		}
+	// the directory is released even if closing fails, so that the log can be opened again
+	err := l.closeSegments()
+	l.unlock()
+	return err
+}
+
+// closeSegments releases the references the log holds on its open segments.
+func (l *Log) closeSegments() error {
+	if err := l.cache.close(); err != nil {
+		return err
+	}
+	if l.activeSegment != nil {
+		return l.activeSegment.release()
 	}
 	return nil
 }
@@ -147,50 +717,82 @@ func (l *Log) Close() error {
 // Truncate removes all segments with base offsets lower than the specified lowest offset.
 // If caller try to truncate the active segment, an error will be returned.
 func (l *Log) Truncate(lowest uint64) error {
-	l.mu.Lock()
+	return l.TruncateContext(context.Background(), lowest)
+}
+
+// TruncateContext is like Truncate, but gives up once the context is done before the segments are dropped from the
+// manifest, returning the context's error. Once they are, the truncation is complete, and their files are removed
+// regardless of the context.
+func (l *Log) TruncateContext(ctx context.Context, lowest uint64) error {
+	if err := l.mu.LockContext(ctx); err != nil {
+		return err
+	}
 	defer l.mu.Unlock()
 
-	if lowest >= l.activeSegment.nextOffset {
+	if l.Config.readOnly {
+		return ErrReadOnly
+	}
+
+	if lowest >= l.activeSegment.nextOffset.Load() {
 		return ErrSegmentActive
 	}
 
-	var segments []*segment
+	var segments, removed []*segment
 	for _, s := range l.segments {
-		if s.nextOffset-1 < lowest {
-			if err := s.Remove(); err != nil {
-				return err
-			}
+		if s.nextOffset.Load()-1 < lowest {
+			removed = append(removed, s)
 		} else {
 			segments = append(segments, s)
 		}
 	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	previous := l.segments
 	l.segments = segments
-	return nil
+	l.publish()
+
+	// drop the segments from the manifest before their files, a crash in between leaves orphans rather than holes
+	if err := l.writeManifest(); err != nil {
+		// the segments may still be listed, keep them so that the truncation can be retried
+		l.segments = previous
+		l.publish()
+		return err
+	}
+	l.txns.prune(segments[0].baseOffset)
+	// the files of segments still being read are removed once their readers are done, files that can't be removed
+	// are left behind as orphans
+	var errs []error
+	for _, s := range removed {
+		errs = append(errs, s.drop(), l.cache.remove(s))
+	}
+	return errors.Join(errs...)
 }
 
 // LowestOffset returns the lowest offset in the log.
 // The api is reserved for distributed log use cases.
 func (l *Log) LowestOffset() (uint64, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	// Invariant: l.segments is never empty after successful initialization.
-	if len(l.segments) == 0 {
+	segments := l.loadSegments()
+	// Invariant: segments is never empty after successful initialization.
+	if len(segments) == 0 {
 		panic("segments list should never be empty")
 	}
-	return l.segments[0].baseOffset, nil
+	return segments[0].baseOffset, nil
 }
 
 // HighestOffset returns the highest offset in the log.
 // The api is reserved for distributed log use cases.
 func (l *Log) HighestOffset() (uint64, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	// Invariant: l.segments is never empty after successful initialization.
-	if len(l.segments) == 0 {
+	segments := l.loadSegments()
+	// Invariant: segments is never empty after successful initialization.
+	if len(segments) == 0 {
 		panic("segments list should never be empty")
 	}
 	// right boundary (exclusive)
-	offset := l.segments[len(l.segments)-1].nextOffset
+	offset := segments[len(segments)-1].nextOffset.Load()
 
 	if offset == 0 {
 		return 0, ErrOffsetOutOfRange
@@ -201,11 +803,10 @@ func (l *Log) HighestOffset() (uint64, error) {
 
 // Length returns the number of records in the log.
 func (l *Log) Length() (uint64, error) {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+	segments := l.loadSegments()
 
-	low := l.segments[0].baseOffset
-	high := l.segments[len(l.segments)-1].nextOffset - 1
+	low := segments[0].baseOffset
+	high := segments[len(segments)-1].nextOffset.Load() - 1
 
 	return high - low + 1, nil
 }
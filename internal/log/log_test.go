@@ -1,13 +1,22 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "github.com/Devin-Yeung/proglog/api/v1"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestLog(t *testing.T) {
@@ -33,6 +42,30 @@ func TestLog(t *testing.T) {
 		{name: "reopen", fn: testReopen},
 		{name: "truncate", fn: testTruncate},
 		{name: "truncate active segment", fn: testTruncateActive},
+		{name: "read raw", fn: testReadRaw},
+		{name: "append if next offset", fn: testAppendIfNextOffset},
+		{name: "concurrent conditional appends", fn: testConcurrentAppendIfNextOffset},
+		{name: "read range", fn: testReadRange},
+		{
+			name: "read range with sparse index",
+			fn:   testReadRange,
+			cfg:  NewConfig().WithSegmentMaxStoreBytes(1024).WithSegmentIndexIntervalBytes(128),
+		},
+		{
+			name: "record ceiling",
+			fn:   testRecordCeiling,
+			cfg:  NewConfig().WithSegmentMaxRecords(10),
+		},
+		{
+			name: "concurrent reads and writes",
+			fn:   testConcurrentReadWrite,
+			cfg:  NewConfig().WithSegmentMaxStoreBytes(1024),
+		},
+		{
+			name: "concurrent reads and writes with evictions",
+			fn:   testConcurrentReadWrite,
+			cfg:  NewConfig().WithSegmentMaxStoreBytes(1024).WithMaxOpenSegments(1),
+		},
 		{
 			name: "concurrent writes",
 			fn:   testConcurrentWrites,
@@ -49,6 +82,13 @@ func TestLog(t *testing.T) {
 			// the lifetime of the log should be managed by each test
 			tc.fn(t, log)
 		})
+		// the in-memory log behaves the same
+		t.Run(tc.name+" in memory", func(t *testing.T) {
+			config := *configFor(tc.cfg)
+			log, err := NewLog("log", *config.WithInMemory())
+			require.NoError(t, err)
+			tc.fn(t, log)
+		})
 	}
 }
 
@@ -149,6 +189,212 @@ func testReopen(t *testing.T, log *Log) {
 	require.NoError(t, err)
 }
 
+func testReadRaw(t *testing.T, log *Log) {
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("testing record %d", i))})
+		require.NoError(t, err)
+	}
+	// reopen so that the sealed segments are mapped when opened by a read as well as on roll
+	require.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := uint64(0); i < 20; i++ {
+		p, release, err := log.ReadRaw(i)
+		require.NoError(t, err)
+		got := &api.Record{}
+		assert.NoError(t, proto.Unmarshal(p, got))
+		assert.Equal(t, []byte(fmt.Sprintf("testing record %d", i)), got.Value)
+		assert.Equal(t, i, got.Offset)
+		release()
+		// releasing twice doesn't drop the log's own reference
+		release()
+	}
+
+	_, _, err = log.ReadRaw(20)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	segments := log.loadSegments()
+	require.Greater(t, len(segments), 1)
+	for _, s := range segments[:len(segments)-1] {
+		assert.NotNil(t, s.store.mmap.Load())
+	}
+	assert.Nil(t, log.activeSegment.store.mmap.Load())
+
+	// a view keeps a truncated segment mapped until it is released
+	p, release, err := log.ReadRaw(0)
+	require.NoError(t, err)
+	want := append([]byte(nil), p...)
+	require.NoError(t, log.Truncate(log.activeSegment.baseOffset-1))
+	assert.Equal(t, want, p)
+	release()
+}
+
+func testReadRange(t *testing.T, log *Log) {
+	defer func(log *Log) {
+		err := log.Close()
+		require.NoError(t, err)
+	}(log)
+
+	for i := 0; i < 50; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %02d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.loadSegments()), 1)
+
+	check := func(records []*api.Record, from uint64) {
+		t.Helper()
+		for i, record := range records {
+			offset := from + uint64(i)
+			assert.Equal(t, offset, record.Offset)
+			assert.Equal(t, []byte(fmt.Sprintf("record %02d", offset)), record.Value)
+		}
+	}
+
+	// without limits, the records up to the end of the log are returned across segments
+	records, next, err := log.ReadRange(5, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 45)
+	require.Equal(t, uint64(50), next)
+	check(records, 5)
+
+	// the number of records is limited
+	records, next, err = log.ReadRange(7, 20, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 20)
+	require.Equal(t, uint64(27), next)
+	check(records, 7)
+
+	// and so is their size, each record encodes to the same size
+	size := uint64(proto.Size(records[0]))
+	records, next, err = log.ReadRange(3, 0, 4*size+size/2)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, uint64(7), next)
+	check(records, 3)
+
+	// but the first record is returned even if it is larger
+	records, next, err = log.ReadRange(3, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(4), next)
+
+	// the end of the log has no records yet
+	records, next, err = log.ReadRange(50, 10, 0)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(50), next)
+
+	// offsets beyond the end or truncated are out of range
+	_, _, err = log.ReadRange(51, 10, 0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.NoError(t, log.Truncate(log.loadSegments()[1].baseOffset))
+	_, _, err = log.ReadRange(0, 10, 0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func testRecordCeiling(t *testing.T, log *Log) {
+	defer func(log *Log) {
+		err := log.Close()
+		require.NoError(t, err)
+	}(log)
+
+	for i := 0; i < 35; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("test data %d", i))})
+		assert.NoError(t, err)
+	}
+
+	// the segments roll after every 10 records
+	require.Len(t, log.segments, 4)
+	for i, s := range log.segments {
+		assert.Equal(t, uint64(i*10), s.baseOffset)
+	}
+
+	for i := uint64(0); i < 35; i++ {
+		got, err := log.Read(i)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("test data %d", i)), got.Value)
+	}
+}
+
+func testConcurrentReadWrite(t *testing.T, log *Log) {
+	defer func(log *Log) {
+		err := log.Close()
+		require.NoError(t, err)
+	}(log)
+
+	n := uint64(2000)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// a writer appending records, rolling many small segments
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := uint64(0); i < n; i++ {
+			_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			assert.NoError(t, err)
+		}
+	}()
+
+	// a truncator dropping old segments behind the writer
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			high, err := log.HighestOffset()
+			if err != nil || high < 100 {
+				continue
+			}
+			err = log.Truncate(high - 100)
+			assert.NoError(t, err)
+		}
+	}()
+
+	// readers racing the writer and the truncator
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				low, err := log.LowestOffset()
+				assert.NoError(t, err)
+				high, err := log.HighestOffset()
+				if err != nil {
+					continue // nothing appended yet
+				}
+				for offset := low; offset <= high; offset += 7 {
+					got, err := log.Read(offset)
+					if errors.Is(err, ErrOffsetOutOfRange) {
+						continue // truncated in the meantime
+					}
+					assert.NoError(t, err)
+					assert.Equal(t, offset, got.Offset)
+					assert.Equal(t, []byte(fmt.Sprintf("record %d", offset)), got.Value)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	high, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, n-1, high)
+}
+
 func testConcurrentWrites(t *testing.T, log *Log) {
 	defer func(log *Log) {
 		err := log.Close()
@@ -176,3 +422,690 @@ func testConcurrentWrites(t *testing.T, log *Log) {
 	require.NoError(t, err)
 	require.Equal(t, uint64(10000), size)
 }
+
+func testAppendIfNextOffset(t *testing.T, log *Log) {
+	defer func(log *Log) {
+		err := log.Close()
+		require.NoError(t, err)
+	}(log)
+
+	// append across segment boundaries, the expected offset follows the log
+	for i := uint64(0); i < 20; i++ {
+		offset, err := log.AppendIfNextOffset(i, &api.Record{Value: []byte("test data")})
+		require.NoError(t, err)
+		require.Equal(t, i, offset)
+	}
+
+	for _, expected := range []uint64{0, 19, 21} {
+		_, err := log.AppendIfNextOffset(expected, &api.Record{Value: []byte("conflict")})
+		require.ErrorIs(t, err, ErrOffsetConflict)
+		var conflict *OffsetConflictError
+		require.ErrorAs(t, err, &conflict)
+		require.Equal(t, expected, conflict.Expected)
+		require.Equal(t, uint64(20), conflict.Actual)
+	}
+
+	// a conflicting append leaves the log unchanged
+	_, err := log.Read(20)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+func testConcurrentAppendIfNextOffset(t *testing.T, log *Log) {
+	defer func(log *Log) {
+		err := log.Close()
+		require.NoError(t, err)
+	}(log)
+
+	wg := sync.WaitGroup{}
+
+	// every worker appends 50 records, retrying from the actual end of the log on conflicts
+	worker := func(id byte) {
+		defer wg.Done()
+		next := uint64(0)
+		for appended := 0; appended < 50; {
+			offset, err := log.AppendIfNextOffset(next, &api.Record{Value: []byte{id}})
+			var conflict *OffsetConflictError
+			if errors.As(err, &conflict) {
+				next = conflict.Actual
+				continue
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, next, offset)
+			next++
+			appended++
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go worker(byte(i))
+	}
+	wg.Wait()
+
+	// no record was lost or duplicated
+	counts := make(map[byte]int)
+	for offset := uint64(0); offset < 200; offset++ {
+		record, err := log.Read(offset)
+		require.NoError(t, err)
+		counts[record.Value[0]]++
+	}
+	require.Equal(t, map[byte]int{0: 50, 1: 50, 2: 50, 3: 50}, counts)
+	_, err := log.Read(200)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+// syntheticLog builds a log of n in-memory segments holding 10 records each, with a gap of 5 offsets between
+// consecutive segments. The segments have no backing files and are only suitable for offset lookups.
+func syntheticLog(n int) *Log {
+	l := &Log{}
+	base := uint64(0)
+	for i := 0; i < n; i++ {
+		s := &segment{baseOffset: base}
+		s.nextOffset.Store(base + 10)
+		l.segments = append(l.segments, s)
+		base += 15
+	}
+	l.activeSegment = l.segments[len(l.segments)-1]
+	l.publish()
+	return l
+}
+
+func TestSegmentFor(t *testing.T) {
+	l := syntheticLog(100)
+
+	for i, s := range l.segments {
+		// every offset inside a segment resolves to it
+		for offset := s.baseOffset; offset < s.nextOffset.Load(); offset++ {
+			assert.Same(t, s, l.segmentFor(offset), "segment %d, offset %d", i, offset)
+		}
+		// offsets in the gap after a segment resolve to nothing
+		for offset := s.nextOffset.Load(); offset < s.baseOffset+15; offset++ {
+			assert.Nil(t, l.segmentFor(offset), "gap after segment %d, offset %d", i, offset)
+		}
+	}
+
+	// offsets before the first segment
+	l = syntheticLog(3)
+	for _, s := range l.segments {
+		s.baseOffset += 100
+		s.nextOffset.Add(100)
+	}
+	assert.Nil(t, l.segmentFor(0))
+	assert.Nil(t, l.segmentFor(99))
+	assert.Same(t, l.segments[0], l.segmentFor(100))
+}
+
+func BenchmarkSegmentFor(b *testing.B) {
+	for _, n := range []int{10, 1_000, 100_000} {
+		b.Run(fmt.Sprintf("segments=%d", n), func(b *testing.B) {
+			l := syntheticLog(n)
+			high := l.activeSegment.nextOffset.Load()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.segmentFor(uint64(i) % high)
+			}
+		})
+	}
+}
+
+func TestLogManifest(t *testing.T) {
+	config := NewConfig().WithSegmentMaxStoreBytes(128)
+
+	setup := func(t *testing.T) string {
+		dir := t.TempDir()
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		for i := 0; i < 20; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("test data")})
+			require.NoError(t, err)
+		}
+		require.Greater(t, len(log.segments), 2)
+		require.NoError(t, log.Close())
+		return dir
+	}
+
+	t.Run("lists live segments", func(t *testing.T) {
+		dir := setup(t)
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		defer log.Close()
+
+		err = log.Truncate(10)
+		require.NoError(t, err)
+
+		baseOffsets, ok, err := readManifest(osFS{}, dir)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Len(t, baseOffsets, len(log.segments))
+		for i, s := range log.segments {
+			assert.Equal(t, s.baseOffset, baseOffsets[i])
+		}
+	})
+
+	t.Run("reports orphans", func(t *testing.T) {
+		dir := setup(t)
+		// a segment left behind by an interrupted truncation and unrelated files
+		for _, name := range []string{"42.tmp", "42.store", segmentFileNameFor(1000, "store"), "notes.txt"} {
+			require.NoError(t, os.WriteFile(path.Join(dir, name), []byte("garbage"), 0644))
+		}
+
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		defer log.Close()
+
+		assert.ElementsMatch(t, []string{"42.store", segmentFileNameFor(1000, "store")}, log.Orphans())
+		length, err := log.Length()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(20), length)
+	})
+
+	t.Run("rejects missing segments", func(t *testing.T) {
+		dir := setup(t)
+		require.NoError(t, os.Remove(segmentPath(dir, 0, "store")))
+
+		_, err := NewLog(dir, *config)
+		require.ErrorIs(t, err, ErrMissingSegment)
+	})
+
+	t.Run("migrates legacy names", func(t *testing.T) {
+		dir := setup(t)
+		require.NoError(t, os.Remove(path.Join(dir, manifestName)))
+		// rename the segment files to the unpadded names used before manifests were introduced
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		for _, file := range files {
+			match := segmentFileName.FindStringSubmatch(file.Name())
+			if match == nil {
+				continue // the manifest is gone, only the lock file is left
+			}
+			offset, err := strconv.ParseUint(match[1], 10, 64)
+			require.NoError(t, err)
+			legacy := path.Join(dir, fmt.Sprintf("%d.%s", offset, match[2]))
+			require.NoError(t, os.Rename(path.Join(dir, file.Name()), legacy))
+		}
+
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		defer log.Close()
+
+		length, err := log.Length()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(20), length)
+		for i := uint64(0); i < 20; i++ {
+			_, err := log.Read(i)
+			assert.NoError(t, err)
+		}
+		_, err = os.Stat(path.Join(dir, manifestName))
+		require.NoError(t, err)
+	})
+}
+
+func segmentFileNameFor(baseOffset uint64, ext string) string {
+	return path.Base(segmentPath("", baseOffset, ext))
+}
+
+func TestLogOpenSegments(t *testing.T) {
+	dir := t.TempDir()
+	config := NewConfig().WithSegmentMaxRecords(10).WithMaxOpenSegments(2)
+
+	log, err := NewLog(dir, *config)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// rolled segments are kept open up to the limit
+	assert.Equal(t, []uint64{80, 90}, cached(log))
+	require.NoError(t, log.Close())
+
+	// a crash left part of a record behind the last one of a sealed segment
+	f, err := os.OpenFile(segmentPath(dir, 0, "store"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	sealedFiles := func() map[string][]byte {
+		files := make(map[string][]byte)
+		for base := uint64(0); base < 90; base += 10 {
+			for _, ext := range []string{"store", "index"} {
+				b, err := os.ReadFile(segmentPath(dir, base, ext))
+				require.NoError(t, err)
+				files[segmentPath(dir, base, ext)] = b
+			}
+		}
+		return files
+	}
+	before := sealedFiles()
+
+	log, err = NewLog(dir, *config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	// only the active segment is opened on startup
+	segments := log.loadSegments()
+	require.Len(t, segments, 11)
+	openSegments := func() (n int) {
+		for _, s := range segments {
+			s.mu.Lock()
+			if s.open {
+				n++
+			}
+			s.mu.Unlock()
+		}
+		return n
+	}
+	require.Equal(t, 1, openSegments())
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(99), off)
+
+	// sealed segments are opened on demand, the least recently used are closed beyond the limit
+	for i := uint64(0); i < 100; i++ {
+		got, err := log.Read(i)
+		require.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d", i)), got.Value)
+		assert.LessOrEqual(t, openSegments(), 3)
+	}
+	assert.ElementsMatch(t, []uint64{80, 90}, cached(log))
+	// opening them on demand does not modify their files
+	assert.Equal(t, before, sealedFiles())
+
+	// reading a segment makes it the most recently used, so the other one is closed next
+	_, err = log.Read(80)
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []uint64{0, 80}, cached(log))
+
+	// a segment in use by a reader stays open when evicted
+	p, release, err := log.ReadRaw(5)
+	require.NoError(t, err)
+	for i := uint64(10); i < 40; i += 10 {
+		_, err := log.Read(i)
+		require.NoError(t, err)
+	}
+	assert.NotContains(t, cached(log), uint64(0))
+	got := &api.Record{}
+	require.NoError(t, proto.Unmarshal(p, got))
+	assert.Equal(t, []byte("record 5"), got.Value)
+	release()
+	require.Equal(t, 3, openSegments())
+
+	// truncating removes the files of closed segments as well
+	require.NoError(t, log.Truncate(50))
+	for _, s := range segments[:5] {
+		_, err := os.Stat(segmentPath(dir, s.baseOffset, "store"))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	_, err = log.Read(20)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+}
+
+// cached returns the base offsets of the segments kept open by the log's cache.
+func cached(log *Log) []uint64 {
+	log.cache.mu.Lock()
+	defer log.cache.mu.Unlock()
+
+	baseOffsets := make([]uint64, len(log.cache.open))
+	for i, s := range log.cache.open {
+		baseOffsets[i] = s.baseOffset
+	}
+	return baseOffsets
+}
+
+// fakeClock is a clock for tests that only advances when told to.
+type fakeClock struct {
+	now atomic.Int64
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, c.now.Load())
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now.Add(int64(d))
+}
+
+func TestLogMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	clock := &fakeClock{}
+	clock.now.Store(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	config := NewConfig().WithSegmentMaxAge(time.Hour)
+	config.now = clock.Now
+
+	log, err := NewLog(dir, *config)
+	require.NoError(t, err)
+
+	baseOffsets := func() []uint64 {
+		var offsets []uint64
+		for _, s := range log.loadSegments() {
+			offsets = append(offsets, s.baseOffset)
+		}
+		return offsets
+	}
+
+	// an empty segment doesn't expire
+	clock.Advance(2 * time.Hour)
+	_, err = log.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0}, baseOffsets())
+
+	// a record appended to an expired segment starts a new one
+	clock.Advance(time.Hour)
+	off, err := log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, []uint64{0, 1}, baseOffsets())
+
+	// the age of a segment survives reopening the log
+	require.NoError(t, log.Close())
+	clock.Advance(time.Hour)
+	log, err = NewLog(dir, *config)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, baseOffsets())
+
+	// so the expired segments can be truncated
+	require.NoError(t, log.Truncate(2))
+	require.Equal(t, []uint64{2}, baseOffsets())
+	got, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), got.Value)
+}
+
+func TestLogMaxAgeBackground(t *testing.T) {
+	config := NewConfig().WithSegmentMaxAge(20 * time.Millisecond)
+
+	log, err := NewLog(t.TempDir(), *config)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+
+	// the segment is rolled without further appends
+	require.Eventually(t, func() bool {
+		return len(log.loadSegments()) == 2
+	}, time.Second, 5*time.Millisecond)
+
+	// the empty segment is not rolled again, and closing stops the background roll
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, log.loadSegments(), 2)
+	require.NoError(t, log.Close())
+	require.NoError(t, log.Close())
+}
+
+func TestLogMaxAgeTiny(t *testing.T) {
+	// half the age is no valid ticker interval
+	log, err := NewLog(t.TempDir(), *NewConfig().WithSegmentMaxAge(time.Nanosecond))
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(log.loadSegments()) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, log.Close())
+}
+
+func TestLogContext(t *testing.T) {
+	log, err := NewLog(t.TempDir(), *NewConfig().WithSegmentMaxRecords(1))
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+
+	// a writer stuck behind another one gives up at its deadline
+	log.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = log.AppendContext(ctx, &api.Record{Value: []byte("late")})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	err = log.TruncateContext(ctx, 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// readers fail on an expired context too, but don't wait for writers
+	_, err = log.ReadContext(ctx, 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	got, err := log.ReadContext(context.Background(), 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record"), got.Value)
+	log.mu.Unlock()
+
+	// nothing was written nor truncated
+	high, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), high)
+	low, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), low)
+
+	// a context that is done already fails even if the lock is available
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = log.AppendContext(ctx, &api.Record{Value: []byte("canceled")})
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = log.ReadContext(ctx, 0)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// and a live one succeeds
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	off, err := log.AppendContext(ctx, &api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.TruncateContext(ctx, 1))
+	got, err = log.ReadContext(ctx, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), got.Offset)
+}
+
+func TestLogProducers(t *testing.T) {
+	dir := t.TempDir()
+	config := NewConfig().WithSegmentMaxStoreBytes(128)
+
+	log, err := NewLog(dir, *config)
+	require.NoError(t, err)
+
+	// every record is retried once, interleaved with records without producer
+	offsets := make(map[uint64]uint64)
+	for seq := uint64(0); seq < 20; seq++ {
+		for range 2 {
+			offset, err := log.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 7, Sequence: seq})
+			require.NoError(t, err)
+			if first, ok := offsets[seq]; ok {
+				require.Equal(t, first, offset)
+			}
+			offsets[seq] = offset
+		}
+		_, err := log.Append(&api.Record{Value: []byte("anonymous")})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	length, err := log.Length()
+	require.NoError(t, err)
+	require.Equal(t, uint64(40), length)
+
+	_, err = log.Append(&api.Record{Value: []byte("stale"), ProducerId: 7, Sequence: 18})
+	require.ErrorIs(t, err, ErrStaleSequence)
+
+	// segments rolled to carry a snapshot of the producers as of their start, the first segment has none
+	_, err = os.Stat(segmentPath(dir, 0, "snapshot"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(segmentPath(dir, log.activeSegment.baseOffset, "snapshot"))
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	retry := func(t *testing.T) {
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		defer log.Close()
+
+		offset, err := log.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 7, Sequence: 19})
+		require.NoError(t, err)
+		require.Equal(t, offsets[19], offset)
+		_, err = log.Append(&api.Record{Value: []byte("stale"), ProducerId: 7, Sequence: 3})
+		require.ErrorIs(t, err, ErrStaleSequence)
+	}
+
+	t.Run("recovers from snapshots", retry)
+
+	t.Run("writes no snapshots without producers", func(t *testing.T) {
+		dir := t.TempDir()
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		for len(log.segments) < 3 {
+			_, err := log.Append(&api.Record{Value: []byte("anonymous")})
+			require.NoError(t, err)
+		}
+		require.NoError(t, log.Close())
+		files, err := filepath.Glob(filepath.Join(dir, "*.snapshot"))
+		require.NoError(t, err)
+		require.Empty(t, files)
+
+		// a missing snapshot is an empty state
+		log, err = NewLog(dir, *config)
+		require.NoError(t, err)
+		defer log.Close()
+		require.Empty(t, log.producers)
+		_, err = log.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 7, Sequence: 0})
+		require.NoError(t, err)
+	})
+
+	t.Run("truncation removes snapshots", func(t *testing.T) {
+		log, err := NewLog(dir, *config)
+		require.NoError(t, err)
+		defer log.Close()
+
+		// roll a segment to write its snapshot again
+		n := len(log.segments)
+		for seq := uint64(20); len(log.segments) == n; seq++ {
+			_, err := log.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 7, Sequence: seq})
+			require.NoError(t, err)
+		}
+		_, err = log.Append(&api.Record{Value: []byte("anonymous")})
+		require.NoError(t, err)
+		lowest := log.segments[len(log.segments)-1].baseOffset
+		dropped := log.segments[len(log.segments)-2].baseOffset
+		_, err = os.Stat(segmentPath(dir, dropped, "snapshot"))
+		require.NoError(t, err)
+
+		// the snapshot of the segment left holds the state of the records truncated
+		require.NoError(t, log.Truncate(lowest))
+		_, err = os.Stat(segmentPath(dir, dropped, "snapshot"))
+		require.ErrorIs(t, err, os.ErrNotExist)
+		_, err = os.Stat(segmentPath(dir, lowest, "snapshot"))
+		require.NoError(t, err)
+	})
+}
+
+func TestLogTruncateKeepsState(t *testing.T) {
+	dir := t.TempDir()
+	config := NewConfig().WithSegmentMaxStoreBytes(128)
+
+	log, err := NewLog(dir, *config)
+	require.NoError(t, err)
+
+	// a transaction opened in a segment about to be truncated, and a producer
+	txn, err := log.Append(&api.Record{Value: []byte("open"), TransactionId: 3})
+	require.NoError(t, err)
+	var last uint64
+	for seq := uint64(0); seq < 10; seq++ {
+		last, err = log.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 7, Sequence: seq})
+		require.NoError(t, err)
+	}
+	for log.activeSegment.baseOffset <= last || log.activeSegment.nextOffset.Load() == log.activeSegment.baseOffset {
+		_, err := log.Append(&api.Record{Value: []byte("anonymous")})
+		require.NoError(t, err)
+	}
+	lowest := log.activeSegment.baseOffset
+	require.NoError(t, log.Truncate(lowest))
+
+	check := func(t *testing.T, log *Log) {
+		t.Helper()
+		offset, err := log.Append(&api.Record{Value: []byte("idempotent"), ProducerId: 7, Sequence: 9})
+		require.NoError(t, err)
+		require.Equal(t, last, offset)
+		require.Equal(t, []uint64{3}, log.openTransactions())
+		require.Equal(t, txn, log.StableOffset())
+	}
+	check(t, log)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, *config)
+	require.NoError(t, err)
+	defer log.Close()
+	check(t, log)
+}
+
+func TestLogLock(t *testing.T) {
+	dir := t.TempDir()
+	config := NewConfig()
+
+	log, err := NewLog(dir, *config)
+	require.NoError(t, err)
+
+	// a second writer is refused while the first one holds the lock
+	_, err = NewLog(dir, *config)
+	require.ErrorIs(t, err, ErrLogLocked)
+
+	// the lock is released on close
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, *config)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func TestLogReadOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	// a read-only log can't initialize a directory
+	_, err := NewLog(dir, *NewConfig().WithReadOnly())
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	writer, err := NewLog(dir, *NewConfig().WithSegmentMaxStoreBytes(128))
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := writer.Append(&api.Record{Value: []byte(fmt.Sprintf("test data %d", i))})
+		require.NoError(t, err)
+	}
+	// flush the buffered store of the active segment
+	err = writer.activeSegment.Flush()
+	require.NoError(t, err)
+
+	// the reader opens the directory while the writer holds the lock and sees the records written so far
+	reader, err := NewLog(dir, *NewConfig().WithSegmentMaxStoreBytes(128).WithReadOnly())
+	require.NoError(t, err)
+
+	length, err := reader.Length()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), length)
+	for i := uint64(0); i < 20; i++ {
+		got, err := reader.Read(i)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("test data %d", i)), got.Value)
+	}
+
+	_, err = reader.Append(&api.Record{Value: []byte("test data")})
+	require.ErrorIs(t, err, ErrReadOnly)
+	err = reader.Truncate(10)
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	// closing the reader leaves the files of the writer alone
+	require.NoError(t, reader.Close())
+	_, err = writer.Append(&api.Record{Value: []byte("test data 20")})
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	writer, err = NewLog(dir, *NewConfig().WithSegmentMaxStoreBytes(128))
+	require.NoError(t, err)
+	defer writer.Close()
+	length, err = writer.Length()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(21), length)
+}
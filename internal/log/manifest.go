@@ -0,0 +1,113 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// manifestName is the name of the manifest file in the log directory.
+	manifestName = "MANIFEST"
+	// manifestVersion is the first line of the manifest, identifying its format.
+	manifestVersion = "proglog manifest v1"
+)
+
+var (
+	// segmentFileName matches the names of segment files: a zero-padded 20-digit base offset and an extension.
+	segmentFileName = regexp.MustCompile(`^([0-9]{20})\.(store|index|snapshot)$`)
+	// legacySegmentFileName matches segment files named before base offsets were zero-padded.
+	legacySegmentFileName = regexp.MustCompile(`^([0-9]+)\.(store|index|snapshot)$`)
+)
+
+// segmentPath returns the path of the segment file with the given base offset and extension (e.g. "store").
+// Base offsets are zero-padded to the width of the largest uint64, so that file names sort in offset order.
+func segmentPath(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%020d.%s", baseOffset, ext))
+}
+
+// readManifest returns the base offsets of the live segments listed in the manifest of the directory. It reports
+// false if the directory has no manifest.
+//
+// The manifest is a text file listing one zero-padded base offset per line, in increasing order:
+//
+//	proglog manifest v1
+//	00000000000000000000
+//	00000000000000000128
+func readManifest(fs filesystem, dir string) ([]uint64, bool, error) {
+	p, err := fs.ReadFile(path.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	if !scanner.Scan() || scanner.Text() != manifestVersion {
+		return nil, false, fmt.Errorf("%w: unknown manifest format", ErrInvalidManifest)
+	}
+
+	var baseOffsets []uint64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		offset, err := strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+		if n := len(baseOffsets); n > 0 && offset <= baseOffsets[n-1] {
+			return nil, false, fmt.Errorf("%w: base offsets out of order", ErrInvalidManifest)
+		}
+		baseOffsets = append(baseOffsets, offset)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return baseOffsets, true, nil
+}
+
+// writeManifest atomically replaces the manifest of the directory with one listing the given base offsets. The new
+// manifest is written to a temporary file, synced and renamed over the old one, so that a crash leaves either the old
+// or the new manifest behind.
+func writeManifest(fs filesystem, dir string, baseOffsets []uint64) error {
+	var buf bytes.Buffer
+	buf.WriteString(manifestVersion + "\n")
+	for _, offset := range baseOffsets {
+		fmt.Fprintf(&buf, "%020d\n", offset)
+	}
+
+	return writeFileAtomic(fs, path.Join(dir, manifestName), buf.Bytes())
+}
+
+// writeFileAtomic replaces the file with the given contents by writing a temporary file next to it, syncing it and
+// renaming it over the file, so that a crash leaves either the old or the new file behind.
+func writeFileAtomic(fs filesystem, name string, p []byte) error {
+	tmp := name + ".tmp"
+	f, err := fs.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(p); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmp)
+		return err
+	}
+
+	if err := fs.Rename(tmp, name); err != nil {
+		return err
+	}
+	return fs.SyncDir(path.Dir(name))
+}
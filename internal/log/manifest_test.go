@@ -0,0 +1,49 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	// no manifest yet
+	_, ok, err := readManifest(osFS{}, dir)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	want := []uint64{0, 128, 1 << 40}
+	err = writeManifest(osFS{}, dir, want)
+	require.NoError(t, err)
+
+	got, ok, err := readManifest(osFS{}, dir)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, want, got)
+
+	// the temporary file does not outlive the rename
+	_, err = os.Stat(path.Join(dir, manifestName+".tmp"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestManifestInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown format": "something else\n0\n",
+		"not a number":   manifestVersion + "\nabc\n",
+		"out of order":   manifestVersion + "\n00000000000000000128\n00000000000000000000\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.WriteFile(path.Join(dir, manifestName), []byte(content), 0644)
+			require.NoError(t, err)
+
+			_, _, err = readManifest(osFS{}, dir)
+			require.ErrorIs(t, err, ErrInvalidManifest)
+		})
+	}
+}
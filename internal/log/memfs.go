@@ -0,0 +1,348 @@
+package log
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memFS is a filesystem keeping its files in memory, for logs that need no durability (see Config.WithInMemory).
+// Directories exist implicitly: a file name is a directory and a base name, and any directory can be read and locked.
+type memFS struct {
+	mu sync.Mutex
+	// files holds the files by name.
+	files map[string]*memData
+	// locked holds the locked directories.
+	locked map[string]struct{}
+}
+
+// newMemFS returns an empty in-memory filesystem.
+func newMemFS() *memFS {
+	return &memFS{
+		files:  make(map[string]*memData),
+		locked: make(map[string]struct{}),
+	}
+}
+
+func (m *memFS) Lock(dir string) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = path.Clean(dir)
+	if _, ok := m.locked[dir]; ok {
+		return nil, ErrLogLocked
+	}
+	m.locked[dir] = struct{}{}
+	return &memLock{fs: m, dir: dir}, nil
+}
+
+func (m *memFS) OpenFile(name string, flag int, _ os.FileMode) (file, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	data, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		data = &memData{modTime: time.Now()}
+		m.files[name] = data
+	}
+	if flag&os.O_TRUNC != 0 {
+		if err := data.truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	return &memFile{
+		name:     name,
+		data:     data,
+		append:   flag&os.O_APPEND != 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR) != 0,
+	}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	data, ok := m.files[path.Clean(name)]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	data.mu.RLock()
+	defer data.mu.RUnlock()
+	return slices.Clone(data.b), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	var entries []os.DirEntry
+	for file, data := range m.files {
+		if path.Dir(file) == name {
+			entries = append(entries, memDirEntry{name: path.Base(file), data: data})
+		}
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	// open files keep their data, like unlinked files
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) SyncDir(string) error {
+	return nil
+}
+
+// Map returns the bytes of the file: the mapping and the file share their memory. The memory of the file is grown
+// to the length of the mapping, so that the file can grow up to it without moving.
+func (m *memFS) Map(f file, length int64, _ bool) ([]byte, error) {
+	data := f.(*memFile).data
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	if length < 0 {
+		length = int64(len(data.b))
+	}
+	if int64(cap(data.b)) < length {
+		b := make([]byte, len(data.b), length)
+		copy(b, data.b)
+		data.b = b
+	}
+	return data.b[:length:length], nil
+}
+
+func (m *memFS) SyncMap([]byte) error {
+	return nil
+}
+
+func (m *memFS) Unmap([]byte) error {
+	return nil
+}
+
+// memLock is the lock of a directory of a memFS.
+type memLock struct {
+	fs   *memFS
+	dir  string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		defer l.fs.mu.Unlock()
+		delete(l.fs.locked, l.dir)
+	})
+	return nil
+}
+
+// memData is the content of a file of a memFS, shared by its open files.
+type memData struct {
+	mu      sync.RWMutex
+	b       []byte
+	modTime time.Time
+}
+
+// truncate changes the size of the file. Growing it within its capacity keeps the memory, which mappings share. The
+// caller must hold d.mu.
+func (d *memData) truncate(size int64) error {
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	n := int64(len(d.b))
+	switch {
+	case size <= n:
+		d.b = d.b[:size]
+	case size <= int64(cap(d.b)):
+		d.b = d.b[:size]
+		clear(d.b[n:])
+	default:
+		d.b = append(d.b, make([]byte, size-n)...)
+	}
+	d.modTime = time.Now()
+	return nil
+}
+
+// memFile is an open file of a memFS.
+type memFile struct {
+	name     string
+	data     *memData
+	append   bool
+	writable bool
+	// off is the position of the next write, unless the file is opened for appending.
+	off    int64
+	closed bool
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	if f.append {
+		f.off = int64(len(f.data.b))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.data.b)) {
+		if err := f.data.truncate(end); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(f.data.b[f.off:], p)
+	f.off += int64(n)
+	f.data.modTime = time.Now()
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	f.data.mu.RLock()
+	defer f.data.mu.RUnlock()
+	if off >= int64(len(f.data.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return memFileInfo{name: path.Base(f.name), data: f.data}, nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: fs.ErrPermission}
+	}
+
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+	return f.data.truncate(size)
+}
+
+// memFileInfo describes a file of a memFS.
+type memFileInfo struct {
+	name string
+	data *memData
+}
+
+func (i memFileInfo) Name() string {
+	return i.name
+}
+
+func (i memFileInfo) Size() int64 {
+	i.data.mu.RLock()
+	defer i.data.mu.RUnlock()
+	return int64(len(i.data.b))
+}
+
+func (i memFileInfo) Mode() fs.FileMode {
+	return 0644
+}
+
+func (i memFileInfo) ModTime() time.Time {
+	i.data.mu.RLock()
+	defer i.data.mu.RUnlock()
+	return i.data.modTime
+}
+
+func (i memFileInfo) IsDir() bool {
+	return false
+}
+
+func (i memFileInfo) Sys() any {
+	return nil
+}
+
+// memDirEntry is the entry of a file of a memFS in its directory.
+type memDirEntry struct {
+	name string
+	data *memData
+}
+
+func (e memDirEntry) Name() string {
+	return e.name
+}
+
+func (e memDirEntry) IsDir() bool {
+	return false
+}
+
+func (e memDirEntry) Type() fs.FileMode {
+	return 0
+}
+
+func (e memDirEntry) Info() (fs.FileInfo, error) {
+	return memFileInfo{name: e.name, data: e.data}, nil
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := newMemFS()
+
+	_, err := fs.OpenFile("dir/a", os.O_RDWR, 0644)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	f, err := fs.OpenFile("dir/a", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.Write([]byte(" world"))
+	require.NoError(t, err)
+
+	p := make([]byte, 5)
+	_, err = f.ReadAt(p, 6)
+	require.NoError(t, err)
+	require.Equal(t, []byte("world"), p)
+	n, err := f.ReadAt(p, 8)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 3, n)
+
+	// a writable mapping shares the memory of the file, which can grow up to the length of the mapping
+	m, err := fs.Map(f, 32, true)
+	require.NoError(t, err)
+	require.Len(t, m, 32)
+	require.NoError(t, f.Truncate(16))
+	copy(m[11:], "!")
+	b, err := fs.ReadFile("dir/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world!\x00\x00\x00\x00"), b)
+	require.NoError(t, fs.Unmap(m))
+
+	// truncating and growing again zeroes the memory
+	require.NoError(t, f.Truncate(5))
+	require.NoError(t, f.Truncate(8))
+	b, err = fs.ReadFile("dir/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello\x00\x00\x00"), b)
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(8), info.Size())
+	require.NoError(t, f.Close())
+
+	require.NoError(t, fs.Rename("dir/a", "dir/b"))
+	_, err = fs.ReadFile("dir/a")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	entries, err := fs.ReadDir("dir")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "b", entries[0].Name())
+
+	require.NoError(t, fs.Remove("dir/b"))
+	require.ErrorIs(t, fs.Remove("dir/b"), os.ErrNotExist)
+	entries, err = fs.ReadDir("dir")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestLogInMemory(t *testing.T) {
+	config := NewConfig().WithSegmentMaxStoreBytes(128).WithInMemory()
+	log, err := NewLog("log", *config)
+	require.NoError(t, err)
+
+	for i := range 100 {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 10)
+	// nothing is written to disk
+	_, err = os.Stat("log")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the directory is locked like on disk
+	_, err = NewLog("log", *config)
+	require.ErrorIs(t, err, ErrLogLocked)
+	// other directories, and other in-memory configs, are other logs
+	other, err := NewLog("other", *config)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+	other, err = NewLog("log", *NewConfig().WithInMemory())
+	require.NoError(t, err)
+	_, err = other.Read(0)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+	require.NoError(t, other.Close())
+
+	lowest := log.segments[5].baseOffset
+	require.NoError(t, log.Truncate(lowest))
+	require.NoError(t, log.Close())
+
+	// the records survive until the process exits
+	log, err = NewLog("log", *config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Empty(t, log.Orphans())
+
+	got, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, got)
+	for offset := lowest; offset < 100; offset++ {
+		record, err := log.Read(offset)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte(fmt.Sprintf("record %d", offset)), record.Value)
+		}
+	}
+	_, err = log.Read(lowest - 1)
+	require.ErrorIs(t, err, ErrOffsetOutOfRange)
+
+	// truncated segments are gone from memory
+	entries, err := config.files().ReadDir("log")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		match := segmentFileName.FindStringSubmatch(entry.Name())
+		if match != nil {
+			assert.GreaterOrEqual(t, match[1], fmt.Sprintf("%020d", lowest))
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The model-based tests run random sequences of operations against a log and a model of it, a slice of records, and
+// compare every observable result. Sequences that make them differ are shrunk to a minimal failing sequence.
+
+// model is the reference the log is checked against. It holds the records in a slice, and the segments as their base
+// offsets: a segment is rolled once the records appended to it fill maxStoreBytes, and truncation drops whole segments.
+type model struct {
+	maxStoreBytes uint64
+	// bases holds the base offsets of the segments, the last one is the active segment.
+	bases []uint64
+	// values holds the values of the records from the base offset of the first segment.
+	values [][]byte
+	// size is the size of the store of the active segment.
+	size uint64
+}
+
+func newModel(c modelConfig) *model {
+	return &model{
+		maxStoreBytes: c.maxStoreBytes,
+		bases:         []uint64{c.initialOffset},
+		size:          headerWidth,
+	}
+}
+
+func (m *model) lowest() uint64 {
+	return m.bases[0]
+}
+
+func (m *model) next() uint64 {
+	return m.lowest() + uint64(len(m.values))
+}
+
+func (m *model) append(value []byte) uint64 {
+	offset := m.next()
+	m.values = append(m.values, value)
+	m.size += lenWidth + uint64(proto.Size(&api.Record{Value: value, Offset: offset}))
+	if m.size >= m.maxStoreBytes {
+		m.bases = append(m.bases, offset+1)
+		m.size = headerWidth
+	}
+	return offset
+}
+
+func (m *model) read(offset uint64) ([]byte, error) {
+	if offset < m.lowest() || offset >= m.next() {
+		return nil, ErrOffsetOutOfRange
+	}
+	return m.values[offset-m.lowest()], nil
+}
+
+func (m *model) readRange(from, maxRecords uint64) ([][]byte, uint64, error) {
+	if from == m.next() {
+		return nil, from, nil
+	}
+	if from < m.lowest() || from > m.next() {
+		return nil, from, ErrOffsetOutOfRange
+	}
+	values := m.values[from-m.lowest():]
+	if maxRecords > 0 && uint64(len(values)) > maxRecords {
+		values = values[:maxRecords]
+	}
+	return values, from + uint64(len(values)), nil
+}
+
+func (m *model) truncate(lowest uint64) error {
+	if lowest >= m.next() {
+		return ErrSegmentActive
+	}
+	// a segment is dropped if its last record is below the lowest offset
+	i := 0
+	for i < len(m.bases)-1 && m.bases[i+1]-1 < lowest {
+		i++
+	}
+	m.values = m.values[m.bases[i]-m.lowest():]
+	m.bases = m.bases[i:]
+	return nil
+}
+
+func (m *model) highestOffset() (uint64, error) {
+	if m.next() == 0 {
+		return 0, ErrOffsetOutOfRange
+	}
+	return m.next() - 1, nil
+}
+
+// modelConfig is the configuration of the log of a model-based test.
+type modelConfig struct {
+	maxStoreBytes uint64
+	indexInterval uint64
+	format        SegmentFormat
+	initialOffset uint64
+	maxOpen       int
+	inMemory      bool
+}
+
+func randomModelConfig(r *rand.Rand) modelConfig {
+	c := modelConfig{
+		// larger than the header of a store, which would be full with no records
+		maxStoreBytes: uint64(64 + r.Intn(512)),
+		format:        SegmentFormat(1 + r.Intn(2)),
+		maxOpen:       1 + r.Intn(4),
+		inMemory:      r.Intn(2) == 0,
+	}
+	if r.Intn(2) == 0 {
+		c.indexInterval = uint64(r.Intn(128))
+	}
+	if r.Intn(2) == 0 {
+		c.initialOffset = uint64(r.Intn(1000))
+	}
+	return c
+}
+
+func (c modelConfig) config() *Config {
+	config := NewConfig().
+		WithSegmentMaxStoreBytes(c.maxStoreBytes).
+		WithSegmentIndexIntervalBytes(c.indexInterval).
+		WithSegmentFormat(c.format).
+		WithSegmentInitialOffset(c.initialOffset).
+		WithMaxOpenSegments(c.maxOpen)
+	if c.inMemory {
+		config.WithInMemory()
+	}
+	return config
+}
+
+func (c modelConfig) String() string {
+	return fmt.Sprintf("max store bytes %d, index interval %d, format %d, initial offset %d, max open %d, in memory %t",
+		c.maxStoreBytes, c.indexInterval, c.format, c.initialOffset, c.maxOpen, c.inMemory)
+}
+
+// modelOp is an operation of a model-based test. Offsets are picked when the operation runs, from arg and the offsets
+// of the model at the time, so that the operation stays meaningful when the operations before it are shrunk away.
+type modelOp struct {
+	kind  string
+	value []byte
+	arg   uint64
+}
+
+func randomOps(r *rand.Rand, n int) []modelOp {
+	ops := make([]modelOp, n)
+	for i := range ops {
+		switch k := r.Intn(100); {
+		case k < 50:
+			value := make([]byte, r.Intn(48))
+			r.Read(value)
+			ops[i] = modelOp{kind: "append", value: value}
+		case k < 70:
+			ops[i] = modelOp{kind: "read", arg: r.Uint64()}
+		case k < 80:
+			ops[i] = modelOp{kind: "range", arg: r.Uint64()}
+		case k < 93:
+			ops[i] = modelOp{kind: "truncate", arg: r.Uint64()}
+		default:
+			ops[i] = modelOp{kind: "reopen"}
+		}
+	}
+	return ops
+}
+
+// pick returns an offset around the records of the model: mostly within them, sometimes right outside of them.
+func (m *model) pick(arg uint64) uint64 {
+	low := m.lowest() - min(m.lowest(), 2)
+	return low + arg%(m.next()+2-low)
+}
+
+func (op modelOp) String() string {
+	if op.kind == "append" {
+		return fmt.Sprintf("append(%d bytes)", len(op.value))
+	}
+	if op.kind == "reopen" {
+		return op.kind
+	}
+	return fmt.Sprintf("%s(%d)", op.kind, op.arg)
+}
+
+// runModel runs the operations against a new log and the model, and returns the first difference between them.
+func runModel(t *testing.T, c modelConfig, ops []modelOp) (err error) {
+	config := c.config()
+	log, err := NewLog(t.TempDir(), *config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, log.Close())
+	}()
+
+	m := newModel(c)
+	for i, op := range ops {
+		if err := stepModel(log, m, op); err != nil {
+			return fmt.Errorf("op %d %s: %w", i, op, err)
+		}
+		if err := compareModel(log, m); err != nil {
+			return fmt.Errorf("after op %d %s: %w", i, op, err)
+		}
+		if op.kind == "reopen" {
+			if err := log.Close(); err != nil {
+				return fmt.Errorf("op %d %s: %w", i, op, err)
+			}
+			if log, err = NewLog(log.Dir, *config); err != nil {
+				return fmt.Errorf("op %d %s: %w", i, op, err)
+			}
+			if err := compareModel(log, m); err != nil {
+				return fmt.Errorf("after op %d %s: %w", i, op, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stepModel runs an operation against the log and the model, and compares their results.
+func stepModel(log *Log, m *model, op modelOp) error {
+	switch op.kind {
+	case "append":
+		want := m.append(op.value)
+		got, err := log.Append(&api.Record{Value: op.value})
+		if err != nil {
+			return err
+		}
+		if got != want {
+			return fmt.Errorf("appended at offset %d, want %d", got, want)
+		}
+	case "read":
+		offset := m.pick(op.arg)
+		want, wantErr := m.read(offset)
+		record, err := log.Read(offset)
+		if wantErr != nil || err != nil {
+			if !errors.Is(err, wantErr) || wantErr == nil {
+				return fmt.Errorf("read %d: %v, want %v", offset, err, wantErr)
+			}
+			return nil
+		}
+		if record.Offset != offset || !bytes.Equal(record.Value, want) {
+			return fmt.Errorf("read %d: record at offset %d with value %x, want %x", offset, record.Offset,
+				record.Value, want)
+		}
+	case "range":
+		from, maxRecords := m.pick(op.arg), op.arg%8
+		want, wantNext, wantErr := m.readRange(from, maxRecords)
+		records, next, err := log.ReadRange(from, maxRecords, 0)
+		if wantErr != nil || err != nil {
+			if !errors.Is(err, wantErr) || wantErr == nil {
+				return fmt.Errorf("read range from %d: %v, want %v", from, err, wantErr)
+			}
+			return nil
+		}
+		if len(records) != len(want) || next != wantNext {
+			return fmt.Errorf("read range from %d: %d records up to %d, want %d up to %d", from, len(records), next,
+				len(want), wantNext)
+		}
+		for j, record := range records {
+			if record.Offset != from+uint64(j) || !bytes.Equal(record.Value, want[j]) {
+				return fmt.Errorf("read range from %d: record %d at offset %d with value %x, want %x", from, j,
+					record.Offset, record.Value, want[j])
+			}
+		}
+	case "truncate":
+		lowest := m.pick(op.arg)
+		wantErr := m.truncate(lowest)
+		if err := log.Truncate(lowest); !errors.Is(err, wantErr) {
+			return fmt.Errorf("truncate to %d: %v, want %v", lowest, err, wantErr)
+		}
+	}
+	return nil
+}
+
+// compareModel compares the offsets of the log with the ones of the model.
+func compareModel(log *Log, m *model) error {
+	lowest, err := log.LowestOffset()
+	if err != nil || lowest != m.lowest() {
+		return fmt.Errorf("lowest offset %d (%v), want %d", lowest, err, m.lowest())
+	}
+	highest, err := log.HighestOffset()
+	wantHighest, wantErr := m.highestOffset()
+	if !errors.Is(err, wantErr) || highest != wantHighest {
+		return fmt.Errorf("highest offset %d (%v), want %d (%v)", highest, err, wantHighest, wantErr)
+	}
+	length, err := log.Length()
+	if err != nil || length != uint64(len(m.values)) {
+		return fmt.Errorf("length %d (%v), want %d", length, err, len(m.values))
+	}
+	if bases := log.loadSegments(); len(bases) != len(m.bases) {
+		return fmt.Errorf("%d segments, want %d", len(bases), len(m.bases))
+	}
+	return nil
+}
+
+// shrinkModel removes operations from a failing sequence as long as it keeps failing, and returns the shortest
+// failing sequence found.
+func shrinkModel(t *testing.T, c modelConfig, ops []modelOp) []modelOp {
+	for chunk := len(ops) / 2; chunk > 0; chunk /= 2 {
+		for i := 0; i+chunk <= len(ops); {
+			shrunk := append(ops[:i:i], ops[i+chunk:]...)
+			if runModel(t, c, shrunk) != nil {
+				ops = shrunk
+			} else {
+				i += chunk
+			}
+		}
+	}
+	return ops
+}
+
+func TestLogModel(t *testing.T) {
+	for seed := range int64(200) {
+		r := rand.New(rand.NewSource(seed))
+		c := randomModelConfig(r)
+		ops := randomOps(r, 200)
+		if err := runModel(t, c, ops); err != nil {
+			ops = shrinkModel(t, c, ops)
+			steps := make([]string, len(ops))
+			for i, op := range ops {
+				steps[i] = op.String()
+			}
+			t.Fatalf("seed %d (%s): %v\nshrunk to %d ops: %s\nfailing with: %v", seed, c, err, len(ops),
+				strings.Join(steps, ", "), runModel(t, c, ops))
+		}
+	}
+}
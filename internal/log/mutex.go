@@ -0,0 +1,36 @@
+package log
+
+import "context"
+
+// mutex is a mutual exclusion lock whose waiters can give up once their context is done. It must be created with
+// newMutex.
+type mutex chan struct{}
+
+// newMutex creates an unlocked mutex.
+func newMutex() mutex {
+	return make(mutex, 1)
+}
+
+// Lock locks the mutex, waiting until it is available.
+func (m mutex) Lock() {
+	m <- struct{}{}
+}
+
+// LockContext locks the mutex, or returns the context's error if it is done before the mutex is available.
+func (m mutex) LockContext(ctx context.Context) error {
+	// don't take the lock for a context that is done already, even if the lock is available
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks the mutex.
+func (m mutex) Unlock() {
+	<-m
+}
@@ -0,0 +1,42 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+)
+
+// producer is the deduplication state of a producer: its last appended record.
+type producer struct {
+	// sequence is the sequence number of the last record appended by the producer.
+	sequence uint64
+	// offset is the offset the last record was appended at.
+	offset uint64
+}
+
+// producers tracks the last record appended by each idempotent producer, by producer id. It is only accessed by
+// writers.
+type producers map[uint64]producer
+
+// check reports whether the record of a producer was appended already, and at which offset. A record is new if its
+// sequence number is beyond the last one of its producer, a retry of the last record is a duplicate, and older
+// sequence numbers fail with ErrStaleSequence as their offset is not tracked anymore.
+func (p producers) check(record *api.Record) (offset uint64, duplicate bool, err error) {
+	last, ok := p[record.ProducerId]
+	switch {
+	case record.ProducerId == 0 || !ok || record.Sequence > last.sequence:
+		return 0, false, nil
+	case record.Sequence == last.sequence:
+		return last.offset, true, nil
+	default:
+		return 0, false, fmt.Errorf("%w: producer %d sent sequence %d after %d",
+			ErrStaleSequence, record.ProducerId, record.Sequence, last.sequence)
+	}
+}
+
+// observe records an appended record as the last one of its producer, if it has one.
+func (p producers) observe(record *api.Record) {
+	if record.ProducerId != 0 {
+		p[record.ProducerId] = producer{sequence: record.Sequence, offset: record.Offset}
+	}
+}
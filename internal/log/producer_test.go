@@ -0,0 +1,36 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducersCheck(t *testing.T) {
+	p := make(producers)
+	p.observe(&api.Record{ProducerId: 7, Sequence: 3, Offset: 42})
+	p.observe(&api.Record{Offset: 43}) // no producer
+
+	for _, tc := range []struct {
+		name      string
+		record    *api.Record
+		offset    uint64
+		duplicate bool
+		err       error
+	}{
+		{name: "no producer", record: &api.Record{Sequence: 3}},
+		{name: "new producer", record: &api.Record{ProducerId: 8, Sequence: 0}},
+		{name: "next sequence", record: &api.Record{ProducerId: 7, Sequence: 4}},
+		{name: "gap", record: &api.Record{ProducerId: 7, Sequence: 10}},
+		{name: "retry", record: &api.Record{ProducerId: 7, Sequence: 3}, offset: 42, duplicate: true},
+		{name: "stale", record: &api.Record{ProducerId: 7, Sequence: 2}, err: ErrStaleSequence},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			offset, duplicate, err := p.check(tc.record)
+			require.ErrorIs(t, err, tc.err)
+			require.Equal(t, tc.duplicate, duplicate)
+			require.Equal(t, tc.offset, offset)
+		})
+	}
+}
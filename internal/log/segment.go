@@ -1,79 +1,251 @@
 package log
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
-	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	api "github.com/Devin-Yeung/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
 )
 
 // segment represents a log segment, which consists of a store and an index.
+//
+// The files of a segment are only open while it is referenced. The active segment is referenced by the log, sealed
+// segments by the log's cache of open segments or by their readers, and are opened again on demand once closed.
 type segment struct {
 	// store is the store associated with this segment.
 	store *store
 	// index is the index associated with this segment.
 	index *index
+	// dir is the directory holding the files of this segment.
+	dir string
 	// config holds the configuration for this segment.
 	config Config
 	// baseOffset is the starting point of this segment.
 	baseOffset uint64
-	// nextOffset is the right boundary (exclusive) of this segment.
-	nextOffset uint64
+	// nextOffset is the right boundary (exclusive) of this segment. It is the high-water mark for readers: it is only
+	// advanced by the writer once a record is fully written to the store and index, and published atomically, so that
+	// readers may read every record below it without locking.
+	nextOffset atomic.Uint64
+	// indexedPos is the store position of the record referenced by the last index entry.
+	indexedPos uint64
+	// createdAt is the time the segment was created, or opened if its files don't record it.
+	createdAt time.Time
+	// mu guards open, and serializes opening the files with closing or removing them.
+	mu sync.Mutex
+	// open reports whether the store and index are open.
+	open bool
+	// refs counts the references to the segment: one held by its owner while the files are open, and one per reader
+	// in flight. The files are closed (or removed) when the last reference is released.
+	refs atomic.Int64
+	// removed marks a segment dropped from the log, whose files are removed on the last release.
+	removed atomic.Bool
+	// used is the tick of the last read, for the log's cache to close the least recently used segments first.
+	used atomic.Int64
 }
 
 // newSegment creates a new segment in the specified directory with the given base offset and configuration. The file
-// names for the store and index are derived from the base offset. If index or store are missing, they will be created.
+// names for the store and index are derived from the base offset. If index or store are missing, they will be created
+// with a header describing the segment. Existing files must carry matching headers, or none at all for segments
+// written before headers were introduced.
 func newSegment(dir string, baseOffset uint64, config Config) (*segment, error) {
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     config,
 	}
+	if err := s.openFiles(false); err != nil {
+		return nil, err
+	}
+	s.refs.Store(1) // the reference of the owner
+
+	return s, nil
+}
+
+// newSealedSegment returns a segment that is closed for appends, without opening its files. nextOffset is the right
+// boundary of the segment as recorded by the log; it is replaced with the one found in the files once they are opened
+// by reopen.
+func newSealedSegment(dir string, baseOffset, nextOffset uint64, config Config) *segment {
+	s := &segment{
+		dir:        dir,
+		baseOffset: baseOffset,
+		config:     config,
+	}
+	s.nextOffset.Store(nextOffset)
+	return s
+}
+
+// openFiles opens the store and index of the segment and reads its right boundary from them. Files opened read-only
+// (sealed segments, or those of a read-only log) are never modified: the bytes a crash left behind the last complete
+// record are ignored rather than dropped. The caller must hold s.mu, or own the segment exclusively.
+func (s *segment) openFiles(readOnly bool) error {
+	config := s.config
+	config.readOnly = config.readOnly || readOnly
+	baseOffset := s.baseOffset
+
+	// a read-only segment must exist already
+	storeFlag, indexFlag := os.O_RDWR|os.O_CREATE|os.O_APPEND, os.O_RDWR|os.O_CREATE
+	if config.readOnly {
+		storeFlag, indexFlag = os.O_RDONLY, os.O_RDONLY
+	}
 
 	// handle the store
-	storePath := path.Join(dir, fmt.Sprintf("%d.store", baseOffset))
-	storeFile, err := os.OpenFile(storePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	fs := config.files()
+	storeFile, err := fs.OpenFile(segmentPath(s.dir, baseOffset, "store"), storeFlag, 0644)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if s.store, err = newStore(storeFile); err != nil {
-		return nil, err
+	if s.store, err = newStore(storeFile, config, newHeader(baseOffset, config)); err != nil {
+		_ = storeFile.Close()
+		return err
 	}
 
-	// handle the index
-	indexPath := path.Join(dir, fmt.Sprintf("%d.index", baseOffset))
-	indexFile, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0644)
+	// handle the index, a new index inherits the header of the store so that both files agree
+	indexFile, err := fs.OpenFile(segmentPath(s.dir, baseOffset, "index"), indexFlag, 0644)
 	if err != nil {
-		return nil, err
+		_ = s.store.Close()
+		return err
 	}
 
-	if s.index, err = newIndex(indexFile, config); err != nil {
-		return nil, err
+	if s.index, err = newIndex(indexFile, config, s.store.header); err != nil {
+		_ = indexFile.Close()
+		_ = s.store.Close()
+		return err
+	}
+
+	if err = s.validate(); err != nil {
+		_ = s.Close()
+		return fmt.Errorf("segment %d: %w", baseOffset, err)
+	}
+
+	// the index is written ahead of the store's buffer, a crash leaves entries of records missing from the store
+	s.index.truncate(s.written())
+	if err = s.checkIndex(); err != nil {
+		_ = s.Close()
+		return fmt.Errorf("segment %d: %w", baseOffset, err)
 	}
 
 	// fetch the right boundary offset from the index
-	if lastEntryOffset, _, err := s.index.Read(-1); err != nil {
+	end := s.store.start
+	if lastEntryOffset, pos, err := s.index.Read(-1); err != nil {
 		// todo: error is always EOF here?
-		s.nextOffset = baseOffset // index is empty if eof
+		s.nextOffset.Store(baseOffset) // index is empty if eof
 	} else {
-		s.nextOffset = baseOffset + uint64(lastEntryOffset) + 1
+		// a sparse index does not reference every record, count the records stored behind the last entry
+		var n uint64
+		if n, end, err = s.count(pos); err != nil {
+			_ = s.Close()
+			return err
+		}
+		if next := lastEntryOffset + n; next < n || baseOffset+next < baseOffset {
+			_ = s.Close()
+			return fmt.Errorf("segment %d: %w: last index entry at offset %d overflows", baseOffset, ErrInvalidSegment,
+				lastEntryOffset)
+		}
+		s.indexedPos = pos
+		s.nextOffset.Store(baseOffset + lastEntryOffset + n)
+		// the last entry must hold the record of its offset, a corrupted offset would move the end of the segment
+		if _, err := s.Read(baseOffset + lastEntryOffset); err != nil {
+			_ = s.Close()
+			return fmt.Errorf("segment %d: %w: last index entry: %w", baseOffset, ErrInvalidSegment, err)
+		}
 	}
 
-	return s, nil
+	// the next record must follow the last complete one, not bytes left behind by a crash
+	if !config.readOnly {
+		if err := s.store.Discard(end); err != nil {
+			_ = s.Close()
+			return err
+		}
+	}
+
+	// legacy segments have no header to tell their age, they age from now on
+	s.createdAt = s.store.header.createdAt
+	if s.createdAt.IsZero() {
+		s.createdAt = config.clock()
+	}
+
+	s.open = true
+	return nil
+}
+
+// validate checks that the store and index agree with each other and with the segment.
+func (s *segment) validate() error {
+	legacyStore, legacyIndex := s.store.start == 0, s.index.start == 0
+	if legacyStore != legacyIndex {
+		return fmt.Errorf("%w: only one of store and index has a header", ErrInvalidSegment)
+	}
+
+	if legacyStore {
+		// without headers, check that the store looks like the start of a segment, the index is checked on its own
+		if s.store.size > 0 {
+			next, err := s.store.Next(0)
+			if err != nil || next > s.store.size {
+				return fmt.Errorf("%w: first record exceeds the store", ErrInvalidSegment)
+			}
+		}
+		return nil
+	}
+
+	if err := s.store.header.validate(s.baseOffset); err != nil {
+		return err
+	}
+	if !s.store.header.equal(s.index.header) {
+		return fmt.Errorf("%w: store and index headers differ", ErrInvalidSegment)
+	}
+	return nil
+}
+
+// checkIndex checks that the entries of the index describe the store: the first entry is the first record, and the
+// offsets and positions strictly increase up to a position within the store. A corrupted index could otherwise make
+// the segment end anywhere, and its binary searches rely on the order.
+func (s *segment) checkIndex() error {
+	n := s.index.len()
+	if n == 0 {
+		return nil
+	}
+	prevOffset, prevPos := s.index.entry(0)
+	if prevOffset != 0 || prevPos != s.store.start {
+		return fmt.Errorf("%w: first index entry is not the first record", ErrInvalidSegment)
+	}
+	for j := uint64(1); j < n; j++ {
+		offset, pos := s.index.entry(j)
+		if offset <= prevOffset || pos <= prevPos {
+			return fmt.Errorf("%w: index entry %d is out of order", ErrInvalidSegment, j)
+		}
+		prevOffset, prevPos = offset, pos
+	}
+	if prevPos >= s.store.size {
+		return fmt.Errorf("%w: index entry %d points past the store", ErrInvalidSegment, n-1)
+	}
+	return nil
 }
 
 // Append adds a new record to the segment and returns the offset of the appended record.
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
-	cur := s.nextOffset
-	record.Offset = cur
+	cur := s.nextOffset.Load()
+	if cur-s.baseOffset >= s.maxRecords() {
+		return 0, ErrSegmentFull
+	}
 
-	// serialize the record
+	// serialize the record with its offset, which the caller's record only gets once it is appended
+	prev := record.Offset
+	record.Offset = cur
 	p, err := proto.Marshal(record)
+	record.Offset = prev
 	if err != nil {
 		return 0, err
 	}
+	if uint64(len(p)) > s.config.maxRecordBytes {
+		return 0, fmt.Errorf("%w: %d bytes", ErrRecordTooLarge, len(p))
+	}
 
 	// append to the store
 	_, pos, err := s.store.Append(p)
@@ -81,42 +253,139 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		return 0, err
 	}
 
-	// append to the index
-	relativeOffset := uint32(s.nextOffset - s.baseOffset)
-	if err = s.index.Write(relativeOffset, pos); err != nil {
-		return 0, err
+	// append to the index, a sparse index skips records close to the previous entry
+	if s.index.len() == 0 || pos-s.indexedPos >= s.config.segment.indexIntervalBytes {
+		if err = s.index.Write(cur-s.baseOffset, pos); err != nil {
+			// the record is not appended, its bytes must not be taken for the next record
+			return 0, errors.Join(err, s.store.Discard(pos))
+		}
+		s.indexedPos = pos
 	}
 
-	s.nextOffset += 1
+	// publish the record to readers
+	s.nextOffset.Store(cur + 1)
+	record.Offset = cur
 	return cur, nil
 }
 
 // Read retrieves a record from the segment at the specified **absolute** offset.
 func (s *segment) Read(offset uint64) (*api.Record, error) {
-	relativeOffset := int64(offset - s.baseOffset)
+	// unmarshal copies the bytes out of a mapped store
+	p, err := s.ReadRaw(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// unmarshal the record, a corrupted index may point to another record
+	record := &api.Record{}
+	if err = proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	if record.Offset != offset {
+		return nil, fmt.Errorf("%w: record at offset %d holds offset %d", ErrInvalidSegment, offset, record.Offset)
+	}
+
+	return record, nil
+}
+
+// ReadRaw returns the encoded record at the specified **absolute** offset. For a sealed segment, the bytes are a view
+// into the mapped store, valid until the segment is closed.
+func (s *segment) ReadRaw(offset uint64) ([]byte, error) {
+	if offset < s.baseOffset || offset >= s.nextOffset.Load() {
+		return nil, io.EOF
+	}
 
 	// retrieve the position from the index
-	_, pos, err := s.index.Read(relativeOffset)
+	pos, err := s.position(offset - s.baseOffset)
 	if err != nil {
 		return nil, err
 	}
 
 	// read the record from the store
-	p, err := s.store.Read(pos)
+	return s.store.View(pos)
+}
+
+// scan calls fn with the encoded records from the specified **absolute** offset to the end of the segment, until fn
+// returns false. The store is read sequentially after a single index lookup. The bytes passed to fn are only valid
+// during the call.
+func (s *segment) scan(from uint64, fn func(p []byte) bool) error {
+	end := s.nextOffset.Load()
+	if from < s.baseOffset || from >= end {
+		return io.EOF
+	}
+
+	pos, err := s.position(from - s.baseOffset)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	for off := from; off < end; off++ {
+		p, err := s.store.View(pos)
+		if err != nil {
+			return err
+		}
+		if !fn(p) {
+			return nil
+		}
+		pos += lenWidth + uint64(len(p))
+	}
+	return nil
+}
 
-	// unmarshal the record
-	record := &api.Record{}
-	if err = proto.Unmarshal(p, record); err != nil {
-		return nil, err
+// position returns the store position of the record at the given relative offset.
+func (s *segment) position(offset uint64) (uint64, error) {
+	// a dense index holds the entry of each record at the slot of its offset
+	if off, pos, err := s.index.Read(int64(offset)); err == nil && off == offset {
+		return pos, nil
 	}
 
-	return record, nil
+	// otherwise scan the store forward from the nearest preceding entry
+	off, pos, err := s.index.Search(offset)
+	if err != nil {
+		return 0, err
+	}
+	for ; off < offset; off++ {
+		if pos, err = s.store.Next(pos); err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+// written returns the number of index entries whose records are completely written to the store. Entries are in
+// store order, so the entries of records missing from the store (e.g. after a crash, or with a concurrent writer of a
+// read-only segment) are the last ones. They are dropped from the end, so that every open of the segment agrees on its
+// end even if a corrupted entry in the middle points past the store.
+func (s *segment) written() uint64 {
+	n := s.index.len()
+	for ; n > 0; n-- {
+		_, pos := s.index.entry(n - 1)
+		if next, err := s.store.Next(pos); err == nil && next <= s.store.size && next > pos {
+			break
+		}
+	}
+	return n
 }
 
-// Remove removes the segment's store and index files from disk.
+// count returns the number of complete records stored from the given position to the end of the store, and the
+// position following them. Records that were only partially written (e.g. by a crash, or by a concurrent writer of a
+// read-only segment) are not counted.
+func (s *segment) count(pos uint64) (uint64, uint64, error) {
+	var n uint64
+	for pos+lenWidth <= s.store.size {
+		next, err := s.store.Next(pos)
+		if errors.Is(err, ErrRecordTooLarge) || err == nil && next > s.store.size {
+			break // the last record was only partially written
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		pos = next
+		n++
+	}
+	return n, pos, nil
+}
+
+// Remove removes the segment's files from disk.
 func (s *segment) Remove() error {
 	// remove the index
 	if err := s.index.Remove(); err != nil {
@@ -126,9 +395,112 @@ func (s *segment) Remove() error {
 	if err := s.store.Remove(); err != nil {
 		return err
 	}
+	return s.removeSnapshot()
+}
+
+// removeSnapshot removes the state snapshot of the segment, which only segments rolled to may have.
+func (s *segment) removeSnapshot() error {
+	if err := s.config.files().Remove(segmentPath(s.dir, s.baseOffset, "snapshot")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
+// Flush writes the records buffered by the segment's store to disk.
+func (s *segment) Flush() error {
+	return s.store.Flush()
+}
+
+// Seal marks the segment as closed for appends: its store is flushed and memory-mapped for reading.
+func (s *segment) Seal() error {
+	return s.store.Seal()
+}
+
+// acquire takes a reference on the segment, which keeps its files open until the reference is released. It reports
+// false if the last reference was released already, i.e. the segment is closed or removed.
+func (s *segment) acquire() bool {
+	for {
+		n := s.refs.Load()
+		if n <= 0 {
+			return false
+		}
+		if s.refs.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// reopen takes a reference on a sealed segment whose files may be closed, opening them read-only and sealing them if
+// necessary. It reports whether the owner's reference was taken as well, in which case the caller becomes the owner.
+// It fails with ErrOffsetOutOfRange if the segment was removed.
+func (s *segment) reopen() (owner bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.removed.Load() {
+		return false, ErrOffsetOutOfRange
+	}
+	// release drops references without s.mu, so refs is only incremented while positive: the files stay open until
+	// the reference taken is released
+	if s.acquire() {
+		return false, nil
+	}
+
+	// the files are still open if the last reference was released but not closed yet, the release then finds refs
+	// positive again and leaves them open
+	if !s.open {
+		if err := s.openFiles(true); err != nil {
+			return false, err
+		}
+		if err := s.Seal(); err != nil {
+			_ = s.Close()
+			s.open = false
+			return false, err
+		}
+	}
+	s.refs.Store(2) // the reference of the owner, and of the reader
+	return true, nil
+}
+
+// release drops a reference on the segment. Releasing the last reference closes the segment, or removes it if it
+// was marked as removed.
+func (s *segment) release() error {
+	if s.refs.Add(-1) > 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the segment may have been reopened, or closed already by a concurrent release
+	if s.refs.Load() > 0 || !s.open {
+		return nil
+	}
+	s.open = false
+	if s.removed.Load() {
+		return s.Remove()
+	}
+	return s.Close()
+}
+
+// drop marks the segment as removed from the log. If the files are open, they are removed on the last release, which
+// is up to the owner; otherwise they are removed right away.
+func (s *segment) drop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removed.Store(true)
+	if s.open {
+		return nil
+	}
+	for _, ext := range []string{"index", "store"} {
+		if err := s.config.files().Remove(segmentPath(s.dir, s.baseOffset, ext)); err != nil {
+			return err
+		}
+	}
+	return s.removeSnapshot()
+}
+
 // Close closes the segment's store and index.
 func (s *segment) Close() error {
 	if err := s.index.Close(); err != nil {
@@ -142,7 +514,33 @@ func (s *segment) Close() error {
 	return nil
 }
 
+// IsFull reports whether the segment should be rolled: its store or index reached the configured size, or it holds as
+// many records as its index can address.
 func (s *segment) IsFull() bool {
 	return s.store.size >= s.config.segment.maxStoreBytes ||
-		s.index.size >= s.config.segment.maxIndexBytes
+		s.index.size.Load() >= s.config.segment.maxIndexBytes ||
+		s.nextOffset.Load()-s.baseOffset >= s.maxRecords()
+}
+
+// IsExpired reports whether the segment should be rolled because it is older than the configured maximum age. An empty
+// segment never expires.
+func (s *segment) IsExpired() bool {
+	maxAge := s.config.segment.maxAge
+	if maxAge == 0 || s.nextOffset.Load() == s.baseOffset {
+		return false
+	}
+	return s.config.clock().Sub(s.createdAt) >= maxAge
+}
+
+// maxRecords returns the maximum number of records the segment may hold.
+func (s *segment) maxRecords() uint64 {
+	// relative offsets start at 0, so the largest one is the (n-1)-th record
+	n := s.index.format.maxOffset()
+	if n < math.MaxUint64 {
+		n++
+	}
+	if limit := s.config.segment.maxRecords; limit > 0 && limit < n {
+		n = limit
+	}
+	return n
 }
@@ -2,15 +2,18 @@ package log
 
 import (
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"os"
-	"path"
 	"testing"
+	"time"
 
 	api "github.com/Devin-Yeung/proglog/api/v1"
 	"github.com/docker/go-units"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestSegment(t *testing.T) {
@@ -71,8 +74,8 @@ func TestSegmentRemove(t *testing.T) {
 	}
 
 	// get the file paths before removing
-	storePath := path.Join(tmpdir, fmt.Sprintf("%d.store", baseOffset))
-	indexPath := path.Join(tmpdir, fmt.Sprintf("%d.index", baseOffset))
+	storePath := segmentPath(tmpdir, uint64(baseOffset), "store")
+	indexPath := segmentPath(tmpdir, uint64(baseOffset), "index")
 
 	// verify files exist before removal
 	_, err = os.Stat(storePath)
@@ -91,3 +94,293 @@ func TestSegmentRemove(t *testing.T) {
 	_, err = os.Stat(indexPath)
 	require.ErrorIs(t, err, os.ErrNotExist)
 }
+
+func TestSegmentSparseIndex(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	c := NewConfig().
+		WithSegmentMaxStoreBytes(10 * units.MiB).
+		WithSegmentIndexIntervalBytes(256)
+
+	baseOffset := uint64(rand.Int())
+
+	s, err := newSegment(tmpdir, baseOffset, *c)
+	require.NoError(t, err)
+
+	n := uint64(100)
+	for i := uint64(0); i < n; i++ {
+		offset, err := s.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", baseOffset+i))})
+		assert.NoError(t, err)
+		assert.Equal(t, baseOffset+i, offset)
+	}
+
+	// the index holds far fewer entries than records
+	assert.Less(t, s.index.len(), n/4)
+
+	check := func(s *segment) {
+		for i := uint64(0); i < n; i++ {
+			got, err := s.Read(baseOffset + i)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(fmt.Sprintf("record %d", baseOffset+i)), got.Value)
+		}
+		_, err := s.Read(baseOffset + n)
+		assert.ErrorIs(t, err, io.EOF)
+	}
+	check(s)
+
+	err = s.Close()
+	require.NoError(t, err)
+
+	// the reopened segment recovers the records behind the last index entry
+	s, err = newSegment(tmpdir, baseOffset, *c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	assert.Equal(t, baseOffset+n, s.nextOffset.Load())
+	check(s)
+}
+
+func BenchmarkSegmentRead(b *testing.B) {
+	for _, bm := range []struct {
+		name     string
+		interval uint64
+	}{
+		{name: "dense", interval: 0},
+		{name: "sparse=1KiB", interval: 1 * units.KiB},
+		{name: "sparse=4KiB", interval: 4 * units.KiB},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			c := NewConfig().
+				WithSegmentMaxStoreBytes(64 * units.MiB).
+				WithSegmentIndexIntervalBytes(bm.interval)
+
+			s, err := newSegment(b.TempDir(), 0, *c)
+			require.NoError(b, err)
+			defer s.Close()
+
+			n := uint64(10_000)
+			value := make([]byte, 64)
+			for i := uint64(0); i < n; i++ {
+				_, err := s.Append(&api.Record{Value: value})
+				require.NoError(b, err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := s.Read(uint64(i) % n)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(s.index.size.Load()), "index-bytes")
+		})
+	}
+}
+
+func TestSegmentMaxRecords(t *testing.T) {
+	c := NewConfig().WithSegmentMaxRecords(5)
+
+	s, err := newSegment(t.TempDir(), 0, *c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.False(t, s.IsFull())
+		_, err := s.Append(&api.Record{Value: []byte("record")})
+		assert.NoError(t, err)
+	}
+
+	// the segment refuses records beyond the ceiling instead of wrapping the relative offset
+	assert.True(t, s.IsFull())
+	_, err = s.Append(&api.Record{Value: []byte("record")})
+	require.ErrorIs(t, err, ErrSegmentFull)
+}
+
+func TestSegmentHeader(t *testing.T) {
+	tmpdir := t.TempDir()
+	c := NewConfig()
+
+	before := time.Now()
+	s, err := newSegment(tmpdir, 16, *c)
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// both files start with a header describing the segment
+	for _, file := range []struct {
+		path  string
+		magic [8]byte
+	}{
+		{path: segmentPath(tmpdir, 16, "store"), magic: storeMagic},
+		{path: segmentPath(tmpdir, 16, "index"), magic: indexMagic},
+	} {
+		p, err := os.ReadFile(file.path)
+		require.NoError(t, err)
+		h, ok := decodeHeader(p, file.magic)
+		require.True(t, ok, file.path)
+		assert.Equal(t, SegmentFormatV1, h.version)
+		assert.Equal(t, uint64(16), h.baseOffset)
+		assert.False(t, h.createdAt.Before(before.Truncate(time.Second)))
+	}
+
+	// files renamed to a different base offset are rejected
+	for _, ext := range []string{"store", "index"} {
+		err = os.Rename(segmentPath(tmpdir, 16, ext), segmentPath(tmpdir, 32, ext))
+		require.NoError(t, err)
+	}
+	_, err = newSegment(tmpdir, 32, *c)
+	require.ErrorIs(t, err, ErrInvalidSegment)
+
+	// an index in place of a store is rejected
+	err = os.Rename(segmentPath(tmpdir, 32, "index"), segmentPath(tmpdir, 48, "store"))
+	require.NoError(t, err)
+	_, err = newSegment(tmpdir, 48, *c)
+	require.ErrorIs(t, err, ErrInvalidSegment)
+}
+
+func TestSegmentLegacy(t *testing.T) {
+	tmpdir := t.TempDir()
+	c := NewConfig()
+
+	// a segment written before headers were introduced
+	var store, index []byte
+	for i := uint32(0); i < 3; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte(fmt.Sprintf("%d", i)), Offset: uint64(i)})
+		require.NoError(t, err)
+
+		entry := make([]byte, 12)
+		byteOrder.PutUint32(entry, i)
+		byteOrder.PutUint64(entry[4:], uint64(len(store)))
+		index = append(index, entry...)
+
+		store = byteOrder.AppendUint64(store, uint64(len(p)))
+		store = append(store, p...)
+	}
+	require.NoError(t, os.WriteFile(segmentPath(tmpdir, 0, "store"), store, 0644))
+	require.NoError(t, os.WriteFile(segmentPath(tmpdir, 0, "index"), index, 0644))
+
+	s, err := newSegment(tmpdir, 0, *c)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), s.nextOffset.Load())
+
+	// the legacy segment can be extended
+	_, err = s.Append(&api.Record{Value: []byte("3")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(tmpdir, 0, *c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := uint64(0); i < 4; i++ {
+		got, err := s.Read(i)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("%d", i)), got.Value)
+	}
+}
+
+func TestSegmentRefs(t *testing.T) {
+	tmpdir := t.TempDir()
+
+	s, err := newSegment(tmpdir, 0, *NewConfig())
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("record")})
+	require.NoError(t, err)
+
+	// a reader holds a reference while the owner drops the segment
+	require.True(t, s.acquire())
+	s.removed.Store(true)
+	require.NoError(t, s.release())
+
+	// the files outlive the owner's reference
+	_, err = s.Read(0)
+	require.NoError(t, err)
+	_, err = os.Stat(segmentPath(tmpdir, 0, "store"))
+	require.NoError(t, err)
+
+	// and are removed with the reader's
+	require.NoError(t, s.release())
+	_, err = os.Stat(segmentPath(tmpdir, 0, "store"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// no new references can be taken
+	require.False(t, s.acquire())
+}
+
+func TestSegmentMaxRecordBytes(t *testing.T) {
+	s, err := newSegment(t.TempDir(), 0, *NewConfig().WithMaxRecordBytes(64))
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Append(&api.Record{Value: make([]byte, 32)})
+	require.NoError(t, err)
+
+	// the limit applies to the encoded record
+	_, err = s.Append(&api.Record{Value: make([]byte, 64)})
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+
+	// a rejected record takes no offset
+	off, err := s.Append(&api.Record{Value: make([]byte, 32)})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+func TestSegmentCorruptedIndex(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// corrupt changes the last entry of a V2 index, at the last 16 bytes
+		corrupt func(index []byte)
+		// open is the error opening the segment
+		open error
+	}{
+		{
+			name:    "position in the header",
+			corrupt: func(index []byte) { byteOrder.PutUint64(index[len(index)-8:], 16) },
+			open:    ErrInvalidSegment,
+		},
+		{
+			name:    "overflowing offset",
+			corrupt: func(index []byte) { byteOrder.PutUint64(index[len(index)-16:], math.MaxUint64) },
+			open:    ErrInvalidSegment,
+		},
+		{
+			name:    "position of another record",
+			corrupt: func(index []byte) { copy(index[len(index)-8:], index[len(index)-24:]) },
+			open:    ErrInvalidSegment,
+		},
+		{
+			name:    "offset out of order",
+			corrupt: func(index []byte) { byteOrder.PutUint64(index[len(index)-16:], 0) },
+			open:    ErrInvalidSegment,
+		},
+		{
+			name:    "first entry not at the first record",
+			corrupt: func(index []byte) { byteOrder.PutUint64(index[headerWidth:], 808464432) },
+			open:    ErrInvalidSegment,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewConfig().WithSegmentFormat(SegmentFormatV2).WithInMemory()
+			s, err := newSegment("seg", 0, *c)
+			require.NoError(t, err)
+			for range 3 {
+				_, err = s.Append(&api.Record{Value: []byte("record")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Close())
+
+			index, err := c.files().ReadFile(segmentPath("seg", 0, "index"))
+			require.NoError(t, err)
+			tc.corrupt(index)
+			f, err := c.files().OpenFile(segmentPath("seg", 0, "index"), os.O_RDWR|os.O_TRUNC, 0644)
+			require.NoError(t, err)
+			_, err = f.Write(index)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			_, err = newSegment("seg", 0, *c)
+			require.ErrorIs(t, err, tc.open)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// snapshotVersion is the first line of a state snapshot, identifying its format.
+const snapshotVersion = "proglog snapshot v1"
+
+// writeSnapshot atomically writes the snapshot of the state of the producers and transactions as of the start of the
+// segment with the given base offset, i.e. after the records of the segments before it. The snapshot is a text file
+// listing each producer with its id, last sequence number and its offset, the open transactions with the offset of
+// their first record, and the aborted ones with the range of their offsets:
+//
+//	proglog snapshot v1
+//	producer 7 41 1022
+//	open 12 1020
+//	aborted 9 998 1003
+//
+// An empty state writes no snapshot, and removes a stale one left by a roll that failed.
+func writeSnapshot(fs filesystem, dir string, baseOffset uint64, p producers, t *transactions) error {
+	name := segmentPath(dir, baseOffset, "snapshot")
+	if len(p) == 0 && len(t.open) == 0 && len(t.aborted) == 0 {
+		if err := fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotVersion + "\n")
+	for _, id := range slices.Sorted(maps.Keys(p)) {
+		fmt.Fprintf(&buf, "producer %d %d %d\n", id, p[id].sequence, p[id].offset)
+	}
+	for _, id := range slices.Sorted(maps.Keys(t.open)) {
+		fmt.Fprintf(&buf, "open %d %d\n", id, t.open[id])
+	}
+	for _, id := range slices.Sorted(maps.Keys(t.aborted)) {
+		fmt.Fprintf(&buf, "aborted %d %d %d\n", id, t.aborted[id].first, t.aborted[id].last)
+	}
+	return writeFileAtomic(fs, name, buf.Bytes())
+}
+
+// readSnapshot reads the snapshot of the state of the segment with the given base offset. A segment without snapshot
+// has an empty state: none is written then, and segments written before snapshots were introduced predate producers
+// and transactions.
+func readSnapshot(fs filesystem, dir string, baseOffset uint64) (producers, *transactions, error) {
+	name := segmentPath(dir, baseOffset, "snapshot")
+	p, t := make(producers), newTransactions()
+	b, err := fs.ReadFile(name)
+	if os.IsNotExist(err) {
+		return p, t, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	if !scanner.Scan() || scanner.Text() != snapshotVersion {
+		return nil, nil, fmt.Errorf("%w: %s: unknown snapshot format", ErrInvalidSegment, name)
+	}
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		values := make([]uint64, len(fields)-1)
+		for i, field := range fields[1:] {
+			if values[i], err = strconv.ParseUint(field, 10, 64); err != nil {
+				return nil, nil, fmt.Errorf("%w: %s: %v", ErrInvalidSegment, name, err)
+			}
+		}
+		switch {
+		case fields[0] == "producer" && len(values) == 3:
+			p[values[0]] = producer{sequence: values[1], offset: values[2]}
+		case fields[0] == "open" && len(values) == 2:
+			t.open[values[0]] = values[1]
+		case fields[0] == "aborted" && len(values) == 3:
+			t.aborted[values[0]] = abortedTransaction{first: values[1], last: values[2]}
+		default:
+			return nil, nil, fmt.Errorf("%w: %s: malformed entry %q", ErrInvalidSegment, name, scanner.Text())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	t.publish()
+	return p, t, nil
+}
@@ -0,0 +1,68 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	// no snapshot yet, an empty state
+	p, txns, err := readSnapshot(osFS{}, dir, 128)
+	require.NoError(t, err)
+	require.Empty(t, p)
+	require.Empty(t, txns.open)
+	require.Empty(t, txns.aborted)
+
+	wantProducers := producers{7: {sequence: 41, offset: 1022}, 1 << 40: {sequence: 0, offset: 0}}
+	wantTxns := newTransactions()
+	wantTxns.open[12] = 1020
+	wantTxns.open[14] = 1024
+	wantTxns.aborted[9] = abortedTransaction{first: 998, last: 1003}
+	require.NoError(t, writeSnapshot(osFS{}, dir, 128, wantProducers, wantTxns))
+
+	p, txns, err = readSnapshot(osFS{}, dir, 128)
+	require.NoError(t, err)
+	require.Equal(t, wantProducers, p)
+	require.Equal(t, wantTxns.open, txns.open)
+	require.Equal(t, wantTxns.aborted, txns.aborted)
+	require.Equal(t, uint64(1020), txns.view.Load().firstOpen)
+
+	// either part alone makes a snapshot
+	require.NoError(t, writeSnapshot(osFS{}, dir, 256, make(producers), wantTxns))
+	p, txns, err = readSnapshot(osFS{}, dir, 256)
+	require.NoError(t, err)
+	require.Empty(t, p)
+	require.Equal(t, wantTxns.aborted, txns.aborted)
+
+	// an empty state writes no snapshot, and removes a stale one
+	require.NoError(t, writeSnapshot(osFS{}, dir, 128, make(producers), newTransactions()))
+	_, err = os.Stat(segmentPath(dir, 128, "snapshot"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	p, txns, err = readSnapshot(osFS{}, dir, 128)
+	require.NoError(t, err)
+	require.Empty(t, p)
+	require.Empty(t, txns.open)
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown format": "something else\nproducer 1 2 3\n",
+		"unknown kind":   snapshotVersion + "\ncommitted 1 2\n",
+		"missing field":  snapshotVersion + "\nproducer 1 2\n",
+		"extra field":    snapshotVersion + "\nopen 1 2 3\n",
+		"not a number":   snapshotVersion + "\naborted 1 x 3\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.WriteFile(segmentPath(dir, 0, "snapshot"), []byte(content), 0644)
+			require.NoError(t, err)
+
+			_, _, err = readSnapshot(osFS{}, dir, 0)
+			require.ErrorIs(t, err, ErrInvalidSegment)
+		})
+	}
+}
@@ -1,10 +1,14 @@
 package log
 
 import (
-	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -14,33 +18,85 @@ var (
 const (
 	// lenWidth is the number of bytes used to store the length of each record.
 	lenWidth = 8
+	// bufferSize is the number of bytes buffered before they are written to the file.
+	bufferSize = 4096
 )
 
 // store is how we persist our log records to disk.
+//
+// Appended records are buffered in memory and written to the file in batches. The number of bytes written to the
+// file is published atomically, so that reads of those bytes go straight to the file without taking the lock or
+// flushing the buffer. Only reads reaching into the buffered tail take the lock, and are served from the buffer.
 type store struct {
 	// File is the underlying file handle used for persistence.
-	*os.File
-	// mu guards concurrent access to the file, buffer, and size.
+	File file
+	// fs is the filesystem of the file.
+	fs filesystem
+	// mu guards concurrent access to the buffer and size, and serializes writes to the file.
 	mu sync.Mutex
-	// buf buffers writes to reduce syscalls and improve performance.
-	buf *bufio.Writer
-	// size is the current number of bytes written to the store.
+	// buf holds the bytes from position flushed to size that are not written to the file yet.
+	buf []byte
+	// size is the current number of bytes written to the store, including the buffered ones.
 	size uint64
+	// flushed is the number of bytes written to the file. Bytes before it are immutable.
+	flushed atomic.Uint64
+	// header is the header of the store file. Legacy store files have none, their header only holds the version.
+	header header
+	// start is the position of the first record, i.e. the size of the header, or 0 for a legacy store.
+	start uint64
+	// maxRecordBytes is the maximum size of a record, larger length prefixes are rejected before allocating.
+	maxRecordBytes uint64
+	// mmap is a read-only mapping of the file, set once the store is sealed. Reads are served from it.
+	mmap atomic.Pointer[[]byte]
 }
 
-func newStore(f *os.File) (*store, error) {
+// newStore creates a new store for the given file. A new store is written with the given header, an existing store
+// keeps the header it was created with.
+func newStore(f file, c Config, h header) (*store, error) {
 	info, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	size := uint64(info.Size())
+	s := &store{
+		File:           f,
+		fs:             c.files(),
+		size:           uint64(info.Size()),
+		buf:            make([]byte, 0, bufferSize),
+		maxRecordBytes: c.maxRecordBytes,
+	}
+	s.flushed.Store(s.size)
+
+	p := make([]byte, headerWidth)
+	if s.size == 0 {
+		// a new store, the header bypasses the buffer so that it is on disk as soon as the file exists
+		h.encode(p, storeMagic)
+		if _, err := f.Write(p); err != nil {
+			// leave the file empty rather than with a partial header, so that it is new again when reopened
+			_ = f.Truncate(0)
+			return nil, err
+		}
+		s.header = h
+		s.start = headerWidth
+		s.size = headerWidth
+		s.flushed.Store(headerWidth)
+		return s, nil
+	}
 
-	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+	if s.size >= headerWidth {
+		if _, err := f.ReadAt(p, 0); err != nil {
+			return nil, err
+		}
+	}
+	if h, ok := decodeHeader(p, storeMagic); ok {
+		s.header = h
+		s.start = headerWidth
+	} else {
+		// a legacy store without header
+		s.header = header{version: SegmentFormatV1}
+		s.start = 0
+	}
+	return s, nil
 }
 
 // Append writes p to the store and returns the number of bytes written, the position
@@ -53,58 +109,214 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 
 	pos = s.size
 	// encoding the length of the record
-	if err := binary.Write(s.buf, byteOrder, uint64(len(p))); err != nil {
-		return 0, 0, err
-	}
-
+	s.buf = byteOrder.AppendUint64(s.buf, uint64(len(p)))
 	// writing the record itself
-	nn, err := s.buf.Write(p)
-	if err != nil {
-		return 0, 0, err
-	}
+	s.buf = append(s.buf, p...)
 
-	nn += lenWidth
-	s.size += uint64(nn)
+	n = uint64(len(p)) + lenWidth
+	s.size += n
 
-	return uint64(nn), pos, nil
+	if len(s.buf) >= bufferSize {
+		if err := s.flush(); err != nil {
+			// the record is not appended, the records buffered before it are written by the next flush
+			return 0, 0, errors.Join(err, s.discard(pos))
+		}
+	}
+
+	return n, pos, nil
 }
 
-// Read reads a record from the store at the given position.
-func (s *store) Read(pos uint64) ([]byte, error) {
+// Discard drops the bytes of the store from the given position on, i.e. the records appended from there, whether they
+// were written to the file already or are still buffered. It undoes appends that could not be completed.
+func (s *store) Discard(pos uint64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Flush the buffer to ensure all data is written to the file
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
+	return s.discard(pos)
+}
+
+// discard is Discard for callers holding s.mu.
+func (s *store) discard(pos uint64) error {
+	if pos >= s.size {
+		return nil
+	}
+	if flushed := s.flushed.Load(); pos < flushed {
+		// readers only read records below the next offset of the segment, which does not cover the discarded ones
+		if err := s.File.Truncate(int64(pos)); err != nil {
+			return err
+		}
+		s.flushed.Store(pos)
 	}
+	s.buf = s.buf[:pos-s.flushed.Load()]
+	s.size = pos
+	return nil
+}
 
+// Read reads a record from the store at the given position. The returned bytes are a copy owned by the caller.
+func (s *store) Read(pos uint64) ([]byte, error) {
 	// Read the length of the record
-	sizeBuf := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(sizeBuf, int64(pos)); err != nil {
+	n, err := s.length(pos)
+	if err != nil {
 		return nil, err
 	}
 
-	// Read the record itself
-	b := make([]byte, byteOrder.Uint64(sizeBuf))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	// Read the record itself, a length beyond the limit can only come from a corrupted store
+	if err := s.check(n, pos); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	// an empty record (e.g. the first record without value) may end the file, where reading nothing fails
+	if n == 0 {
+		return b, nil
+	}
+	if _, err := s.ReadAt(b, int64(pos+lenWidth)); err != nil {
 		return nil, err
 	}
 
 	return b, nil
 }
 
-// ReadAt reads len(p) bytes from the store at the given offset.
+// View returns the record at the given position. If the store is sealed, the bytes are a view into the mapping of the
+// file without copying, which is only valid until the store is closed and must not be modified. Otherwise, View is
+// the same as Read.
+func (s *store) View(pos uint64) ([]byte, error) {
+	m := s.mmap.Load()
+	if m == nil {
+		return s.Read(pos)
+	}
+
+	size := uint64(len(*m))
+	if pos >= size || size-pos < lenWidth {
+		return nil, io.EOF
+	}
+	n := byteOrder.Uint64((*m)[pos : pos+lenWidth])
+	if err := s.check(n, pos); err != nil {
+		return nil, err
+	}
+	end := pos + lenWidth + n
+	if end > size || end < pos {
+		return nil, io.EOF
+	}
+	return (*m)[pos+lenWidth : end : end], nil
+}
+
+// check guards against reading a record of the given length at the given position, which exceeds the maximum record
+// size. Such a length prefix is corrupted, unless the limit was lowered after the record was written.
+func (s *store) check(n, pos uint64) error {
+	if n > s.maxRecordBytes {
+		return fmt.Errorf("%w: length prefix of %d bytes at position %d", ErrRecordTooLarge, n, pos)
+	}
+	return nil
+}
+
+// Next returns the position of the record that follows the record at the given position.
+func (s *store) Next(pos uint64) (uint64, error) {
+	n, err := s.length(pos)
+	if err != nil {
+		return 0, err
+	}
+	next := pos + lenWidth + n
+	if next < pos {
+		// only a corrupted length prefix claims a record beyond any file
+		return 0, fmt.Errorf("%w: length prefix of %d bytes at position %d", ErrRecordTooLarge, n, pos)
+	}
+	return next, nil
+}
+
+// length reads the length prefix of the record at the given position.
+func (s *store) length(pos uint64) (uint64, error) {
+	if pos > math.MaxInt64 {
+		return 0, io.EOF // beyond any file, e.g. the position of a corrupted index entry
+	}
+	p := make([]byte, lenWidth)
+	if _, err := s.ReadAt(p, int64(pos)); err != nil {
+		return 0, err
+	}
+	return byteOrder.Uint64(p), nil
+}
+
+// ReadAt reads len(p) bytes from the store at the given offset. Bytes already written to the file are read without
+// locking, bytes still in the buffer are copied from it.
 func (s *store) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if m := s.mmap.Load(); m != nil {
+		if off >= int64(len(*m)) {
+			return 0, io.EOF
+		}
+		if n = copy(p, (*m)[off:]); n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if uint64(off)+uint64(len(p)) <= s.flushed.Load() {
+		return s.File.ReadAt(p, off)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Flush the buffer to ensure all data is written to the file
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	// the buffer may have been written to the file in the meantime, read the part of p that is in the file first
+	flushed := s.flushed.Load()
+	if uint64(off) < flushed {
+		if n, err = s.File.ReadAt(p[:min(uint64(len(p)), flushed-uint64(off))], off); err != nil {
+			return n, err
+		}
+	}
+
+	// the buffer holds the bytes from flushed to size
+	if n < len(p) {
+		if uint64(off)+uint64(n) >= s.size {
+			return n, io.EOF
+		}
+		n += copy(p[n:], s.buf[uint64(off)+uint64(n)-flushed:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// flush writes the buffer to the file and publishes the new flushed size. The caller must hold s.mu.
+func (s *store) flush() error {
+	if len(s.buf) == 0 {
+		return nil
 	}
+	n, err := s.File.Write(s.buf)
+	// a short write leaves the rest of the buffer for the next flush, the file holds no byte twice
+	s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+	s.flushed.Add(uint64(n))
+	return err
+}
+
+// Flush writes the buffered records to the underlying file.
+func (s *store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+// Seal flushes the buffer and maps the file read-only. The store must not be appended to afterward. Reads are served
+// from the mapping, saving a system call and, with View, a copy per record.
+func (s *store) Seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return s.File.ReadAt(p, off)
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if s.size == 0 || s.mmap.Load() != nil {
+		return nil // an empty file can't be mapped
+	}
+
+	m, err := s.fs.Map(s.File, -1, false)
+	if err != nil {
+		return err
+	}
+	s.mmap.Store(&m)
+	return nil
 }
 
 // Close flushes the buffer and closes the underlying file.
@@ -112,11 +324,17 @@ func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	err := s.buf.Flush()
+	err := s.flush()
 	if err != nil {
 		return err
 	}
 
+	if m := s.mmap.Swap(nil); m != nil {
+		if err := s.fs.Unmap(*m); err != nil {
+			return err
+		}
+	}
+
 	return s.File.Close()
 }
 
@@ -125,5 +343,5 @@ func (s *store) Remove() error {
 	if err := s.Close(); err != nil {
 		return err
 	}
-	return os.Remove(s.File.Name())
+	return s.fs.Remove(s.File.Name())
 }
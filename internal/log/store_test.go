@@ -1,7 +1,11 @@
 package log
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -20,14 +24,18 @@ func TestStoreAppendRead(t *testing.T) {
 	defer os.Remove(f.Name())
 
 	// create a new store
-	s, err := newStore(f)
+	s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
 	require.NoError(t, err)
 
 	testAppend(t, s)
 	testRead(t, s)
 
+	// reads are served from the buffer without flushing it, flush before handing the file to another store
+	err = s.Flush()
+	require.NoError(t, err)
+
 	// reopen the store
-	s, err = newStore(f)
+	s, err = newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -37,13 +45,13 @@ func testAppend(t *testing.T, s *store) {
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(dummyWrite)
 		assert.NoError(t, err)
-		assert.Equal(t, pos+n, width*i)
+		assert.Equal(t, pos+n, headerWidth+width*i)
 	}
 }
 
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := uint64(headerWidth)
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		assert.NoError(t, err)
@@ -58,7 +66,7 @@ func TestStoreRemove(t *testing.T) {
 	require.NoError(t, err)
 
 	// create a new store
-	s, err := newStore(f)
+	s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
 	require.NoError(t, err)
 
 	// write some data
@@ -80,3 +88,239 @@ func TestStoreRemove(t *testing.T) {
 	_, err = s.Read(0)
 	require.Error(t, err)
 }
+
+func TestStoreReadBuffered(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_buffered_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
+	require.NoError(t, err)
+	defer s.Close()
+
+	testAppend(t, s)
+
+	// the records are still buffered, reading them doesn't flush
+	testRead(t, s)
+	assert.Equal(t, uint64(headerWidth), s.flushed.Load())
+
+	// a read spanning the file and the buffer
+	err = s.Flush()
+	require.NoError(t, err)
+	_, _, err = s.Append(dummyWrite)
+	require.NoError(t, err)
+
+	p := make([]byte, 2*width)
+	n, err := s.ReadAt(p, int64(headerWidth+2*width))
+	require.NoError(t, err)
+	assert.Equal(t, len(p), n)
+	assert.Equal(t, dummyWrite, p[lenWidth:width])
+	assert.Equal(t, dummyWrite, p[width+lenWidth:])
+
+	// reading beyond the end
+	_, err = s.ReadAt(p, int64(headerWidth+3*width))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestStoreConcurrentReadWrite(t *testing.T) {
+	f, err := os.CreateTemp("", "store_concurrent_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
+	require.NoError(t, err)
+	defer s.Close()
+
+	n := uint64(10_000)
+	var appended atomic.Uint64
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(0); i < n; i++ {
+			_, _, err := s.Append(dummyWrite)
+			assert.NoError(t, err)
+			appended.Add(1)
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint64(0); i < n; i++ {
+				// read one of the records appended so far
+				k := appended.Load()
+				if k == 0 {
+					continue
+				}
+				got, err := s.Read(headerWidth + (i%k)*width)
+				assert.NoError(t, err)
+				assert.Equal(t, dummyWrite, got)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func BenchmarkStoreRead(b *testing.B) {
+	for _, writers := range []int{0, 1, 4} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			f, err := os.CreateTemp(b.TempDir(), "store_bench")
+			require.NoError(b, err)
+
+			s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
+			require.NoError(b, err)
+			defer s.Close()
+
+			// records for the readers
+			n := uint64(10_000)
+			for i := uint64(0); i < n; i++ {
+				_, _, err := s.Append(dummyWrite)
+				require.NoError(b, err)
+			}
+
+			// writers append until the readers are done
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if _, _, err := s.Append(dummyWrite); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var i uint64
+				for pb.Next() {
+					if _, err := s.Read(headerWidth + (i%n)*width); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+			b.StopTimer()
+
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func TestStoreSeal(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_seal_test")
+	require.NoError(t, err)
+
+	s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
+	require.NoError(t, err)
+	defer s.Close()
+
+	testAppend(t, s)
+	require.NoError(t, s.Seal())
+	require.NotNil(t, s.mmap.Load())
+	// sealing twice is harmless
+	require.NoError(t, s.Seal())
+
+	testRead(t, s)
+
+	// views alias the mapping
+	pos := uint64(headerWidth)
+	for i := uint64(1); i < 4; i++ {
+		view, err := s.View(pos)
+		assert.NoError(t, err)
+		assert.Equal(t, dummyWrite, view)
+		assert.Equal(t, &(*s.mmap.Load())[pos+lenWidth], &view[0])
+		pos += width
+	}
+
+	_, err = s.View(pos)
+	require.ErrorIs(t, err, io.EOF)
+	_, err = s.Read(pos)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+// BenchmarkStoreReadSealed compares reading a closed store through the file, its mapping, and views of its mapping.
+func BenchmarkStoreReadSealed(b *testing.B) {
+	read := map[string]func(s *store, pos uint64) ([]byte, error){
+		"file": (*store).Read,
+		"mmap": (*store).Read,
+		"view": (*store).View,
+	}
+	for _, name := range []string{"file", "mmap", "view"} {
+		b.Run(name, func(b *testing.B) {
+			f, err := os.CreateTemp(b.TempDir(), "store_bench")
+			require.NoError(b, err)
+
+			s, err := newStore(f, *NewConfig(), newHeader(0, *NewConfig()))
+			require.NoError(b, err)
+			defer s.Close()
+
+			n := uint64(10_000)
+			for i := uint64(0); i < n; i++ {
+				_, _, err := s.Append(dummyWrite)
+				require.NoError(b, err)
+			}
+			require.NoError(b, s.Flush())
+			if name != "file" {
+				require.NoError(b, s.Seal())
+			}
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				var i uint64
+				for pb.Next() {
+					if _, err := read[name](s, headerWidth+(i%n)*width); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func TestStoreCorruptedLength(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "store_corrupted_length_test")
+	require.NoError(t, err)
+
+	config := NewConfig().WithMaxRecordBytes(1024)
+	s, err := newStore(f, *config, newHeader(0, *config))
+	require.NoError(t, err)
+	defer s.Close()
+
+	testAppend(t, s)
+	require.NoError(t, s.Flush())
+
+	// corrupt the length prefix of the second record to claim 1 TiB
+	p := make([]byte, lenWidth)
+	byteOrder.PutUint64(p, 1<<40)
+	_, err = f.WriteAt(p, int64(headerWidth+width))
+	require.NoError(t, err)
+
+	_, err = s.Read(headerWidth)
+	require.NoError(t, err)
+	_, err = s.Read(headerWidth + width)
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+
+	// sealed stores are guarded as well
+	require.NoError(t, s.Seal())
+	_, err = s.View(headerWidth + width)
+	require.ErrorIs(t, err, ErrRecordTooLarge)
+}
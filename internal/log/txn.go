@@ -0,0 +1,109 @@
+package log
+
+import (
+	"maps"
+	"sync/atomic"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+)
+
+// abortedTransaction is the range of offsets of an aborted transaction, from its first record to its abort marker.
+type abortedTransaction struct {
+	first uint64
+	last  uint64
+}
+
+// transactionView is an immutable copy of the state of the transactions for readers.
+type transactionView struct {
+	// firstOpen is the offset of the first record of the oldest open transaction, if open is set.
+	firstOpen uint64
+	open      bool
+	// aborted holds the aborted transactions by id.
+	aborted map[uint64]abortedTransaction
+}
+
+// transactions tracks the transactions of a log: the open ones by the offset of their first record, and the aborted
+// ones, whose records are hidden from read-committed consumers. The maps are only accessed by writers, readers load
+// the view, which is replaced whenever a transaction starts or ends.
+type transactions struct {
+	open    map[uint64]uint64
+	aborted map[uint64]abortedTransaction
+	view    atomic.Pointer[transactionView]
+}
+
+// newTransactions returns the state of a log without transactions.
+func newTransactions() *transactions {
+	t := &transactions{
+		open:    make(map[uint64]uint64),
+		aborted: make(map[uint64]abortedTransaction),
+	}
+	t.publish()
+	return t
+}
+
+// begin marks the transaction of a record about to be appended at the given offset as open, if it is the first
+// record of the transaction. It must be called before the record is visible to readers, so that they stop before
+// it. It reports whether the transaction was opened.
+func (t *transactions) begin(record *api.Record, offset uint64) bool {
+	if record.TransactionId == 0 || record.Control != api.Control_CONTROL_NONE {
+		return false
+	}
+	if _, ok := t.open[record.TransactionId]; ok {
+		return false
+	}
+	t.open[record.TransactionId] = offset
+	t.publish()
+	return true
+}
+
+// cancel forgets a transaction opened by a record that could not be appended after all.
+func (t *transactions) cancel(id uint64) {
+	delete(t.open, id)
+	t.publish()
+}
+
+// observe applies an appended record to the state: a data record opens its transaction, a marker ends it.
+func (t *transactions) observe(record *api.Record) {
+	id := record.TransactionId
+	if id == 0 {
+		return
+	}
+	first, ok := t.open[id]
+	switch record.Control {
+	case api.Control_CONTROL_NONE:
+		if !ok {
+			t.open[id] = record.Offset
+		}
+		return
+	case api.Control_CONTROL_ABORT:
+		if ok {
+			t.aborted[id] = abortedTransaction{first: first, last: record.Offset}
+		}
+	}
+	delete(t.open, id)
+}
+
+// isOpen reports whether the transaction has records in the log and did not end yet.
+func (t *transactions) isOpen(id uint64) bool {
+	_, ok := t.open[id]
+	return ok
+}
+
+// prune forgets the aborted transactions that ended below the given offset, whose records were truncated.
+func (t *transactions) prune(lowest uint64) {
+	maps.DeleteFunc(t.aborted, func(_ uint64, a abortedTransaction) bool {
+		return a.last < lowest
+	})
+	t.publish()
+}
+
+// publish replaces the view of the readers with a copy of the current state.
+func (t *transactions) publish() {
+	v := &transactionView{aborted: maps.Clone(t.aborted)}
+	for _, first := range t.open {
+		if !v.open || first < v.firstOpen {
+			v.firstOpen, v.open = first, true
+		}
+	}
+	t.view.Store(v)
+}
@@ -0,0 +1,33 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionsObserve(t *testing.T) {
+	txns := newTransactions()
+	for _, record := range []*api.Record{
+		{Offset: 10, TransactionId: 1},
+		{Offset: 11, TransactionId: 2},
+		{Offset: 12, TransactionId: 1},
+		{Offset: 13, TransactionId: 1, Control: api.Control_CONTROL_ABORT},
+		{Offset: 14, TransactionId: 3, Control: api.Control_CONTROL_COMMIT}, // no records, nothing to end
+	} {
+		txns.observe(record)
+	}
+	txns.publish()
+
+	v := txns.view.Load()
+	require.True(t, v.open)
+	require.Equal(t, uint64(11), v.firstOpen)
+	require.Equal(t, map[uint64]abortedTransaction{1: {first: 10, last: 13}}, v.aborted)
+
+	txns.observe(&api.Record{Offset: 15, TransactionId: 2, Control: api.Control_CONTROL_COMMIT})
+	txns.prune(14)
+	v = txns.view.Load()
+	require.False(t, v.open)
+	require.Empty(t, v.aborted)
+}
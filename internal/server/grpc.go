@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// consumePollInterval is how long ConsumeStream waits for a record to be appended once it reached the end of the log.
+const consumePollInterval = 50 * time.Millisecond
+
+// errNoTransactions is returned by the transaction RPCs of a server without coordinator.
+var errNoTransactions = status.Error(codes.Unimplemented, "transactions are not enabled on this server")
+
+type grpcServer struct {
+	api.UnimplementedLogServer
+	Log CommitLog
+	// Coordinator runs the transactions, nil if the server does not support them.
+	Coordinator *log.Coordinator
+}
+
+func newgrpcServer(commitLog CommitLog, coordinator *log.Coordinator) *grpcServer {
+	return &grpcServer{
+		Log:         commitLog,
+		Coordinator: coordinator,
+	}
+}
+
+// NewGRPCServer returns a gRPC server serving the Log service backed by the given commit log. Transactions are run by
+// the given coordinator, which may be shared by the servers of other logs to write to several logs atomically; without
+// a coordinator, the transaction RPCs are unimplemented. Transactions need a commit log of the coordinator.
+func NewGRPCServer(commitLog CommitLog, coordinator *log.Coordinator, opts ...grpc.ServerOption) *grpc.Server {
+	gsrv := grpc.NewServer(opts...)
+	api.RegisterLogServer(gsrv, newgrpcServer(commitLog, coordinator))
+	return gsrv
+}
+
+// Produce appends the record, conditionally if the request holds an expected offset, and responds with its offset.
+// Records of idempotent producers are deduplicated by the log, a retry responds with the offset of the original.
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+	// transactions are only ever written by the coordinator
+	req.Record.TransactionId, req.Record.Control = 0, api.Control_CONTROL_NONE
+	if req.ProducerId != 0 {
+		req.Record.ProducerId, req.Record.Sequence = req.ProducerId, req.Sequence
+	}
+	var offset uint64
+	var err error
+	switch {
+	case req.TransactionId != 0:
+		if s.Coordinator == nil {
+			return nil, errNoTransactions
+		}
+		if req.ExpectedOffset != nil {
+			return nil, status.Error(codes.InvalidArgument, "conditional appends are not supported in transactions")
+		}
+		commitLog, ok := s.Log.(*log.Log)
+		if !ok {
+			return nil, errNoTransactions
+		}
+		offset, err = s.Coordinator.Append(ctx, commitLog, req.TransactionId, req.Record)
+	case req.ExpectedOffset != nil:
+		offset, err = s.Log.AppendIfNextOffsetContext(ctx, *req.ExpectedOffset, req.Record)
+	default:
+		offset, err = s.Log.AppendContext(ctx, req.Record)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.ProduceResponse{Offset: offset}, nil
+}
+
+// Consume returns the record at the requested offset, or NotFound if the consumer does not see it at its isolation
+// level: transaction markers, and for READ_COMMITTED consumers records of open or aborted transactions.
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	record, err := readVisible(ctx, s.Log, req.Offset, req.IsolationLevel)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.ConsumeResponse{Record: record}, nil
+}
+
+// Fetch returns the contiguous records from the requested offset on, within the requested limits or the server's
+// defaults, and the offset to fetch next. Like ConsumeStream, it skips the records the consumer does not see at its
+// isolation level, and stops at the last stable offset for READ_COMMITTED consumers.
+func (s *grpcServer) Fetch(ctx context.Context, req *api.FetchRequest) (*api.FetchResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, grpcError(err)
+	}
+	maxRecords, maxBytes := uint64(req.MaxRecords), req.MaxBytes
+	if maxRecords == 0 {
+		maxRecords = defaultFetchMaxRecords
+	}
+	if maxBytes == 0 {
+		maxBytes = defaultFetchMaxBytes
+	}
+
+	records, next, err := fetch(s.Log, req.Offset, maxRecords, maxBytes, req.IsolationLevel)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.FetchResponse{Records: records, NextOffset: next}, nil
+}
+
+// BeginTransaction starts a transaction.
+func (s *grpcServer) BeginTransaction(ctx context.Context, _ *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	if s.Coordinator == nil {
+		return nil, errNoTransactions
+	}
+	id, err := s.Coordinator.Begin(ctx)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.BeginTransactionResponse{TransactionId: id}, nil
+}
+
+// CommitTransaction commits a transaction in all logs of the coordinator.
+func (s *grpcServer) CommitTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	if s.Coordinator == nil {
+		return nil, errNoTransactions
+	}
+	if err := s.Coordinator.Commit(ctx, req.TransactionId); err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.EndTransactionResponse{}, nil
+}
+
+// AbortTransaction aborts a transaction in all logs of the coordinator.
+func (s *grpcServer) AbortTransaction(ctx context.Context, req *api.EndTransactionRequest) (*api.EndTransactionResponse, error) {
+	if s.Coordinator == nil {
+		return nil, errNoTransactions
+	}
+	if err := s.Coordinator.Abort(ctx, req.TransactionId); err != nil {
+		return nil, grpcError(err)
+	}
+	return &api.EndTransactionResponse{}, nil
+}
+
+// ProduceStream appends every record received on the stream, and responds with its offset.
+func (s *grpcServer) ProduceStream(stream grpc.BidiStreamingServer[api.ProduceRequest, api.ProduceResponse]) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		res, err := s.Produce(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(res); err != nil {
+			return err
+		}
+	}
+}
+
+// ConsumeStream streams the records from the requested offset on, waiting for new records at the end of the log
+// until the client goes away. The markers of transactions are skipped. READ_COMMITTED consumers wait for open
+// transactions to end and skip the records of aborted ones. Offsets truncated from the log fail with OutOfRange.
+func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream grpc.ServerStreamingServer[api.ConsumeResponse]) error {
+	committed := req.IsolationLevel == api.IsolationLevel_READ_COMMITTED
+	offset := req.Offset
+	for {
+		lowest, err := s.Log.LowestOffset()
+		if err != nil {
+			return grpcError(err)
+		}
+		if offset < lowest {
+			return status.Errorf(codes.OutOfRange, "offset %d is below the lowest offset %d of the log", offset, lowest)
+		}
+		if s.endOfLog(offset) || committed && offset >= s.Log.StableOffset() {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-time.After(consumePollInterval):
+				continue
+			}
+		}
+		record, err := s.Log.ReadContext(stream.Context(), offset)
+		if err != nil {
+			return grpcError(err)
+		}
+		offset++
+		if !visible(s.Log, record, req.IsolationLevel) {
+			continue
+		}
+		if err = stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+}
+
+// endOfLog reports whether offset is past the last record of the log, where consumers wait for new records.
+func (s *grpcServer) endOfLog(offset uint64) bool {
+	highest, err := s.Log.HighestOffset()
+	if errors.Is(err, log.ErrOffsetOutOfRange) {
+		return true
+	}
+	return err == nil && offset > highest
+}
+
+// grpcError maps an error of the commit log to a gRPC status.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, log.ErrRecordTooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, log.ErrOffsetOutOfRange):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, errHidden):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, log.ErrOffsetConflict):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, log.ErrStaleSequence), errors.Is(err, log.ErrUnknownTransaction), errors.Is(err, log.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// setupGRPC serves the commit log over an in-memory connection and returns a client for it. Transactions are
+// supported if it is a segmented log.
+func setupGRPC(t *testing.T, commitLog CommitLog) api.LogClient {
+	t.Helper()
+
+	var coordinator *log.Coordinator
+	if l, ok := commitLog.(*log.Log); ok {
+		var err error
+		coordinator, err = log.NewCoordinator(t.TempDir(), *log.NewConfig(), l)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = coordinator.Close() })
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(commitLog, coordinator)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return api.NewLogClient(conn)
+}
+
+func TestGRPCProduceConsume(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		client := setupGRPC(t, b.open(t, 0))
+		ctx := context.Background()
+
+		produced, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		require.NoError(t, err)
+
+		consumed, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produced.Offset})
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello"), consumed.Record.Value)
+
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produced.Offset + 1})
+		require.Equal(t, codes.OutOfRange, status.Code(err))
+	})
+}
+
+func TestGRPCProduceTooLarge(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		client := setupGRPC(t, b.open(t, 16))
+
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 32)}})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
+
+func TestGRPCProduceExpectedOffset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		client := setupGRPC(t, b.open(t, 0))
+		ctx := context.Background()
+		expected := func(offset uint64) *uint64 { return &offset }
+
+		produced, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:         &api.Record{Value: []byte("first")},
+			ExpectedOffset: expected(0),
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), produced.Offset)
+
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record:         &api.Record{Value: []byte("stale")},
+			ExpectedOffset: expected(0),
+		})
+		require.Equal(t, codes.Aborted, status.Code(err))
+
+		_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+		require.Equal(t, codes.OutOfRange, status.Code(err))
+	})
+}
+
+func TestGRPCProduceIdempotent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		client := setupGRPC(t, b.open(t, 0))
+		ctx := context.Background()
+		produce := func(sequence uint64) (*api.ProduceResponse, error) {
+			return client.Produce(ctx, &api.ProduceRequest{
+				Record:     &api.Record{Value: []byte(fmt.Sprintf("record %d", sequence))},
+				ProducerId: 7,
+				Sequence:   sequence,
+			})
+		}
+
+		first, err := produce(0)
+		require.NoError(t, err)
+		retried, err := produce(0)
+		require.NoError(t, err)
+		require.Equal(t, first.Offset, retried.Offset)
+
+		next, err := produce(1)
+		require.NoError(t, err)
+		require.Equal(t, first.Offset+1, next.Offset)
+
+		_, err = produce(0)
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+}
+
+func TestGRPCFetch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		client := setupGRPC(t, b.open(t, 0))
+		ctx := context.Background()
+
+		for i := range 5 {
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}})
+			require.NoError(t, err)
+		}
+
+		fetched, err := client.Fetch(ctx, &api.FetchRequest{Offset: 1, MaxRecords: 3})
+		require.NoError(t, err)
+		require.Len(t, fetched.Records, 3)
+		for i, record := range fetched.Records {
+			assert.Equal(t, uint64(i+1), record.Offset)
+			assert.Equal(t, []byte(fmt.Sprintf("record %d", i+1)), record.Value)
+		}
+		require.Equal(t, uint64(4), fetched.NextOffset)
+
+		// the first record is returned even if it exceeds the byte limit
+		fetched, err = client.Fetch(ctx, &api.FetchRequest{Offset: fetched.NextOffset, MaxBytes: 1})
+		require.NoError(t, err)
+		require.Len(t, fetched.Records, 1)
+		require.Equal(t, uint64(5), fetched.NextOffset)
+
+		fetched, err = client.Fetch(ctx, &api.FetchRequest{Offset: fetched.NextOffset})
+		require.NoError(t, err)
+		require.Empty(t, fetched.Records)
+		require.Equal(t, uint64(5), fetched.NextOffset)
+	})
+}
+
+func TestGRPCConsumeStreamTruncated(t *testing.T) {
+	commitLog, err := log.NewLog(t.TempDir(), *log.NewConfig().WithSegmentMaxStoreBytes(128))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = commitLog.Close() })
+	client := setupGRPC(t, commitLog)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(fmt.Sprintf("record-%d", i))}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, commitLog.Truncate(8))
+	lowest, err := commitLog.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(0))
+
+	// a consumer of truncated records fails instead of waiting forever
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+
+	stream, err = client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: lowest})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, lowest, res.Record.Offset)
+}
+
+func TestGRPCTransactions(t *testing.T) {
+	commitLog, err := log.NewLog(t.TempDir(), *log.NewConfig().WithSegmentMaxStoreBytes(128))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = commitLog.Close() })
+	client := setupGRPC(t, commitLog)
+	ctx := context.Background()
+
+	produce := func(value string, txn uint64) {
+		t.Helper()
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}, TransactionId: txn})
+		require.NoError(t, err)
+	}
+	begin := func() uint64 {
+		t.Helper()
+		res, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{})
+		require.NoError(t, err)
+		return res.TransactionId
+	}
+	consume := func(level api.IsolationLevel, n int) []string {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{IsolationLevel: level})
+		require.NoError(t, err)
+		var values []string
+		for len(values) < n {
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			values = append(values, string(res.Record.Value))
+		}
+		return values
+	}
+	// fetch and consumeEach read the whole log with Fetch and with unary Consume calls, which skip the same records
+	fetch := func(level api.IsolationLevel) []string {
+		t.Helper()
+		var values []string
+		for offset := uint64(0); ; {
+			res, err := client.Fetch(ctx, &api.FetchRequest{Offset: offset, MaxRecords: 2, IsolationLevel: level})
+			require.NoError(t, err)
+			for _, record := range res.Records {
+				values = append(values, string(record.Value))
+			}
+			if res.NextOffset == offset {
+				return values
+			}
+			offset = res.NextOffset
+		}
+	}
+	consumeEach := func(level api.IsolationLevel) []string {
+		t.Helper()
+		highest, err := commitLog.HighestOffset()
+		require.NoError(t, err)
+		var values []string
+		for offset := uint64(0); offset <= highest; offset++ {
+			res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: offset, IsolationLevel: level})
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			require.NoError(t, err)
+			values = append(values, string(res.Record.Value))
+		}
+		return values
+	}
+
+	produce("before", 0)
+	committed := begin()
+	produce("committed", committed)
+	aborted := begin()
+	produce("aborted", aborted)
+	produce("after", 0)
+
+	// the open transaction holds read-committed consumers back
+	require.Equal(t, []string{"before"}, consume(api.IsolationLevel_READ_COMMITTED, 1))
+	require.Equal(t, []string{"before"}, fetch(api.IsolationLevel_READ_COMMITTED))
+	require.Equal(t, []string{"before"}, consumeEach(api.IsolationLevel_READ_COMMITTED))
+	// markers are hidden at any isolation level
+	require.Equal(t, []string{"before", "committed", "aborted", "after"}, fetch(api.IsolationLevel_READ_UNCOMMITTED))
+	require.Equal(t, []string{"before", "committed", "aborted", "after"}, consumeEach(api.IsolationLevel_READ_UNCOMMITTED))
+
+	_, err = client.AbortTransaction(ctx, &api.EndTransactionRequest{TransactionId: aborted})
+	require.NoError(t, err)
+	_, err = client.CommitTransaction(ctx, &api.EndTransactionRequest{TransactionId: committed})
+	require.NoError(t, err)
+	produce("last", 0)
+
+	require.Equal(t, []string{"before", "committed", "after", "last"}, consume(api.IsolationLevel_READ_COMMITTED, 4))
+	require.Equal(t, []string{"before", "committed", "aborted", "after", "last"},
+		consume(api.IsolationLevel_READ_UNCOMMITTED, 5))
+	require.Equal(t, []string{"before", "committed", "after", "last"}, fetch(api.IsolationLevel_READ_COMMITTED))
+	require.Equal(t, []string{"before", "committed", "after", "last"}, consumeEach(api.IsolationLevel_READ_COMMITTED))
+	require.Equal(t, []string{"before", "committed", "aborted", "after", "last"},
+		fetch(api.IsolationLevel_READ_UNCOMMITTED))
+	require.Equal(t, []string{"before", "committed", "aborted", "after", "last"},
+		consumeEach(api.IsolationLevel_READ_UNCOMMITTED))
+
+	// ended transactions take no more records
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("late")}, TransactionId: committed})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestGRPCTransactionsDisabled(t *testing.T) {
+	srv := newgrpcServer(nil, nil)
+
+	_, err := srv.BeginTransaction(context.Background(), &api.BeginTransactionRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = srv.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{}, TransactionId: 1})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestGRPCError(t *testing.T) {
+	for err, code := range map[error]codes.Code{
+		context.DeadlineExceeded:                          codes.DeadlineExceeded,
+		context.Canceled:                                  codes.Canceled,
+		fmt.Errorf("%w: 42 bytes", log.ErrRecordTooLarge): codes.InvalidArgument,
+		log.ErrOffsetOutOfRange:                           codes.OutOfRange,
+		&log.OffsetConflictError{Expected: 1, Actual: 2}:  codes.Aborted,
+		log.ErrStaleSequence:                              codes.FailedPrecondition,
+		log.ErrUnknownTransaction:                         codes.FailedPrecondition,
+		log.ErrReadOnly:                                   codes.FailedPrecondition,
+		fmt.Errorf("%w: offset 3", errHidden):             codes.NotFound,
+	} {
+		assert.Equal(t, code, status.Code(grpcError(err)), err.Error())
+	}
+}
@@ -1,29 +1,36 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
 	"github.com/gorilla/mux"
 )
 
 type httpServer struct {
-	Log *Log
+	Log CommitLog
 }
 
-func newHTTPServer() *httpServer {
+func newHTTPServer(commitLog CommitLog) *httpServer {
 	return &httpServer{
-		Log: NewLog(),
+		Log: commitLog,
 	}
 }
 
-func NewHTTPServer(addr string) *http.Server {
-	s := newHTTPServer()
+// NewHTTPServer returns an HTTP server listening on addr and serving the given commit log.
+func NewHTTPServer(addr string, commitLog CommitLog) *http.Server {
+	s := newHTTPServer(commitLog)
 	r := mux.NewRouter()
 
 	r.HandleFunc("/", s.handleProduce).Methods("POST")
 	r.HandleFunc("/", s.handleConsume).Methods("GET")
+	r.HandleFunc("/records", s.handleFetch).Methods("GET")
 	return &http.Server{
 		Addr:    addr,
 		Handler: r,
@@ -39,9 +46,20 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	offset, err := s.Log.Append(req.Record)
+	record := &api.Record{Value: req.Record.Value, ProducerId: req.Record.ProducerID, Sequence: req.Record.Sequence}
+	// the producer of the request takes precedence over the one of the record, like in the gRPC server
+	if req.ProducerID != 0 {
+		record.ProducerId, record.Sequence = req.ProducerID, req.Sequence
+	}
+	var offset uint64
+	if req.ExpectedOffset != nil {
+		offset, err = s.Log.AppendIfNextOffsetContext(r.Context(), *req.ExpectedOffset, record)
+	} else {
+		offset, err = s.Log.AppendContext(r.Context(), record)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
+		return
 	}
 
 	resp := ProduceResponse{
@@ -60,20 +78,72 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	record, err := s.Log.Read(req.Offset)
-	if errors.Is(err, ErrOffsetNotFound) {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	level, err := isolationLevel(req.IsolationLevel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	record, err := readVisible(r.Context(), s.Log, req.Offset, level)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
 	resp := ConsumeResponse{
-		Record: record,
+		Record: newRecord(record),
+	}
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// handleFetch serves GET /records?from=&limit=&isolation_level=, returning the records among up to limit contiguous
+// records from offset from on that the consumer sees at its isolation level.
+func (s *httpServer) handleFetch(w http.ResponseWriter, r *http.Request) {
+	from, limit := uint64(0), uint64(defaultFetchMaxRecords)
+	query := r.URL.Query()
+	for name, value := range map[string]*uint64{"from": &from, "limit": &limit} {
+		if !query.Has(name) {
+			continue
+		}
+		n, err := strconv.ParseUint(query.Get(name), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		*value = n
+	}
+	if limit == 0 {
+		limit = defaultFetchMaxRecords
+	}
+	level, err := isolationLevel(query.Get("isolation_level"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := r.Context().Err(); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	records, next, err := fetch(s.Log, from, limit, defaultFetchMaxBytes, level)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+
+	resp := FetchResponse{
+		Records:    make([]Record, len(records)),
+		NextOffset: next,
+	}
+	for i, record := range records {
+		resp.Records[i] = newRecord(record)
 	}
 
 	err = json.NewEncoder(w).Encode(resp)
@@ -82,9 +152,65 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// isolationLevel parses the name of an isolation level, READ_UNCOMMITTED if empty.
+func isolationLevel(name string) (api.IsolationLevel, error) {
+	if name == "" {
+		return api.IsolationLevel_READ_UNCOMMITTED, nil
+	}
+	level, ok := api.IsolationLevel_value[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid isolation_level: %q", name)
+	}
+	return api.IsolationLevel(level), nil
+}
+
+// httpStatus maps an error of the log to an HTTP status code.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, log.ErrOffsetOutOfRange), errors.Is(err, errHidden):
+		return http.StatusNotFound
+	case errors.Is(err, log.ErrRecordTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, log.ErrOffsetConflict), errors.Is(err, log.ErrStaleSequence):
+		return http.StatusConflict
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		// like http.TimeoutHandler, the client went away or ran out of time
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Record represents a single log record with its value and offset.
+type Record struct {
+	Value  []byte `json:"value"`
+	Offset uint64 `json:"offset"`
+	// ProducerID identifies the idempotent producer that appended the record, 0 if none.
+	ProducerID uint64 `json:"producer_id,omitempty"`
+	// Sequence is the sequence number of the record among the records of its producer.
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+// newRecord returns the JSON representation of a record of the commit log.
+func newRecord(record *api.Record) Record {
+	return Record{
+		Value:      record.Value,
+		Offset:     record.Offset,
+		ProducerID: record.ProducerId,
+		Sequence:   record.Sequence,
+	}
+}
+
 // ProduceRequest represents a request to produce a log record.
 type ProduceRequest struct {
 	Record Record `json:"record"`
+	// ExpectedOffset makes the append conditional: the record is only appended if it gets this offset.
+	ExpectedOffset *uint64 `json:"expected_offset,omitempty"`
+	// ProducerID makes the append idempotent: a retried record with the last sequence number of its producer is not
+	// appended again, the response holds the offset of the original. It overrides the producer of the record, if any.
+	ProducerID uint64 `json:"producer_id,omitempty"`
+	// Sequence is the sequence number of the record among the records of its producer.
+	Sequence uint64 `json:"sequence,omitempty"`
 }
 
 // ProduceResponse represents a response after producing a log record.
@@ -95,9 +221,18 @@ type ProduceResponse struct {
 // ConsumeRequest represents a request to consume a log record.
 type ConsumeRequest struct {
 	Offset uint64 `json:"offset"`
+	// IsolationLevel is READ_UNCOMMITTED, the default, or READ_COMMITTED. Reading a record the consumer does not see
+	// at its isolation level fails with 404, transaction markers are never seen.
+	IsolationLevel string `json:"isolation_level,omitempty"`
 }
 
 // ConsumeResponse represents a response after consuming a log record.
 type ConsumeResponse struct {
 	Record Record `json:"record"`
 }
+
+// FetchResponse represents a response after fetching log records.
+type FetchResponse struct {
+	Records    []Record `json:"records"`
+	NextOffset uint64   `json:"next_offset"`
+}
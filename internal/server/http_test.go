@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// produceHTTP posts the produce request to the server.
+func produceHTTP(t *testing.T, s *httpServer, req ProduceRequest) *httptest.ResponseRecorder {
+	t.Helper()
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	s.handleProduce(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	return w
+}
+
+func TestHTTPProduceConsume(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := newHTTPServer(b.open(t, 0))
+
+		w := produceHTTP(t, s, ProduceRequest{Record: Record{Value: []byte("hello")}})
+		require.Equal(t, http.StatusOK, w.Code)
+		var produced ProduceResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&produced))
+
+		consume := func(offset uint64) *httptest.ResponseRecorder {
+			body, err := json.Marshal(ConsumeRequest{Offset: offset})
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			s.handleConsume(w, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+			return w
+		}
+
+		w = consume(produced.Offset)
+		require.Equal(t, http.StatusOK, w.Code)
+		var consumed ConsumeResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&consumed))
+		require.Equal(t, Record{Value: []byte("hello"), Offset: produced.Offset}, consumed.Record)
+
+		require.Equal(t, http.StatusNotFound, consume(produced.Offset+1).Code)
+	})
+}
+
+func TestHTTPProduceTooLarge(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := newHTTPServer(b.open(t, 64))
+
+		require.Equal(t, http.StatusOK, produceHTTP(t, s, ProduceRequest{Record: Record{Value: make([]byte, 32)}}).Code)
+		require.Equal(t, http.StatusRequestEntityTooLarge,
+			produceHTTP(t, s, ProduceRequest{Record: Record{Value: make([]byte, 64)}}).Code)
+	})
+}
+
+func TestHTTPProduceExpectedOffset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := newHTTPServer(b.open(t, 0))
+
+		produce := func(expected uint64) int {
+			return produceHTTP(t, s, ProduceRequest{Record: Record{Value: []byte("value")}, ExpectedOffset: &expected}).Code
+		}
+
+		require.Equal(t, http.StatusOK, produce(0))
+		require.Equal(t, http.StatusConflict, produce(0))
+		require.Equal(t, http.StatusConflict, produce(2))
+		require.Equal(t, http.StatusOK, produce(1))
+	})
+}
+
+func TestHTTPProduceIdempotent(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := newHTTPServer(b.open(t, 0))
+
+		produce := func(sequence uint64) *httptest.ResponseRecorder {
+			return produceHTTP(t, s, ProduceRequest{Record: Record{Value: []byte("value")}, ProducerID: 7, Sequence: sequence})
+		}
+		offset := func(w *httptest.ResponseRecorder) uint64 {
+			require.Equal(t, http.StatusOK, w.Code)
+			var resp ProduceResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			return resp.Offset
+		}
+
+		require.Equal(t, uint64(0), offset(produce(3)))
+		require.Equal(t, uint64(0), offset(produce(3)))
+		require.Equal(t, uint64(1), offset(produce(4)))
+		require.Equal(t, http.StatusConflict, produce(3).Code)
+
+		// the producer may be given in the record as well
+		inRecord := func(sequence uint64) *httptest.ResponseRecorder {
+			return produceHTTP(t, s, ProduceRequest{Record: Record{Value: []byte("value"), ProducerID: 7, Sequence: sequence}})
+		}
+		require.Equal(t, uint64(1), offset(inRecord(4)))
+		require.Equal(t, uint64(2), offset(inRecord(5)))
+		require.Equal(t, http.StatusConflict, inRecord(3).Code)
+	})
+}
+
+func TestHTTPCanceled(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := newHTTPServer(b.open(t, 0))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte("canceled")}})
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		s.handleProduce(w, httptest.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewReader(body)))
+
+		require.Equal(t, http.StatusServiceUnavailable, w.Code)
+		_, err = s.Log.HighestOffset()
+		require.Error(t, err)
+	})
+}
+
+func TestHTTPFetch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		s := newHTTPServer(b.open(t, 0))
+		for _, value := range []string{"a", "b", "c"} {
+			require.Equal(t, http.StatusOK, produceHTTP(t, s, ProduceRequest{Record: Record{Value: []byte(value)}}).Code)
+		}
+
+		fetch := func(target string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			s.handleFetch(w, httptest.NewRequest(http.MethodGet, target, nil))
+			return w
+		}
+
+		w := fetch("/records?from=1&limit=1")
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp FetchResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Equal(t, []Record{{Value: []byte("b"), Offset: 1}}, resp.Records)
+		require.Equal(t, uint64(2), resp.NextOffset)
+
+		w = fetch("/records")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Records, 3)
+		require.Equal(t, uint64(3), resp.NextOffset)
+
+		require.Equal(t, http.StatusBadRequest, fetch("/records?from=x").Code)
+		require.Equal(t, http.StatusNotFound, fetch("/records?from=4").Code)
+	})
+}
+
+func TestHTTPTransactions(t *testing.T) {
+	commitLog, err := log.NewLog(t.TempDir(), *log.NewConfig().WithSegmentMaxStoreBytes(128))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = commitLog.Close() })
+	coordinator, err := log.NewCoordinator(t.TempDir(), *log.NewConfig(), commitLog)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = coordinator.Close() })
+	s := newHTTPServer(commitLog)
+	ctx := context.Background()
+
+	// fetch and consumeEach read the whole log with GET /records and with GET / requests, which skip the same records
+	fetch := func(level string) []string {
+		t.Helper()
+		var values []string
+		for offset := uint64(0); ; {
+			w := httptest.NewRecorder()
+			target := fmt.Sprintf("/records?from=%d&limit=2&isolation_level=%s", offset, level)
+			s.handleFetch(w, httptest.NewRequest(http.MethodGet, target, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+			var resp FetchResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			for _, record := range resp.Records {
+				values = append(values, string(record.Value))
+			}
+			if resp.NextOffset == offset {
+				return values
+			}
+			offset = resp.NextOffset
+		}
+	}
+	consumeEach := func(level string) []string {
+		t.Helper()
+		highest, err := commitLog.HighestOffset()
+		require.NoError(t, err)
+		var values []string
+		for offset := uint64(0); offset <= highest; offset++ {
+			body, err := json.Marshal(ConsumeRequest{Offset: offset, IsolationLevel: level})
+			require.NoError(t, err)
+			w := httptest.NewRecorder()
+			s.handleConsume(w, httptest.NewRequest(http.MethodGet, "/", bytes.NewReader(body)))
+			if w.Code == http.StatusNotFound {
+				continue
+			}
+			require.Equal(t, http.StatusOK, w.Code)
+			var resp ConsumeResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			values = append(values, string(resp.Record.Value))
+		}
+		return values
+	}
+
+	require.Equal(t, http.StatusOK, produceHTTP(t, s, ProduceRequest{Record: Record{Value: []byte("before")}}).Code)
+	committed, err := coordinator.Begin(ctx)
+	require.NoError(t, err)
+	_, err = coordinator.Append(ctx, commitLog, committed, &api.Record{Value: []byte("committed")})
+	require.NoError(t, err)
+	aborted, err := coordinator.Begin(ctx)
+	require.NoError(t, err)
+	_, err = coordinator.Append(ctx, commitLog, aborted, &api.Record{Value: []byte("aborted")})
+	require.NoError(t, err)
+
+	// the open transactions hold read-committed consumers back
+	require.Equal(t, []string{"before"}, fetch("READ_COMMITTED"))
+	require.Equal(t, []string{"before"}, consumeEach("READ_COMMITTED"))
+	require.Equal(t, []string{"before", "committed", "aborted"}, fetch(""))
+	require.Equal(t, []string{"before", "committed", "aborted"}, consumeEach("READ_UNCOMMITTED"))
+
+	require.NoError(t, coordinator.Abort(ctx, aborted))
+	require.NoError(t, coordinator.Commit(ctx, committed))
+
+	// markers are hidden at any isolation level, and the records of aborted transactions from read-committed consumers
+	require.Equal(t, []string{"before", "committed"}, fetch("READ_COMMITTED"))
+	require.Equal(t, []string{"before", "committed"}, consumeEach("READ_COMMITTED"))
+	require.Equal(t, []string{"before", "committed", "aborted"}, fetch("READ_UNCOMMITTED"))
+	require.Equal(t, []string{"before", "committed", "aborted"}, consumeEach(""))
+
+	w := httptest.NewRecorder()
+	s.handleFetch(w, httptest.NewRequest(http.MethodGet, "/records?isolation_level=SERIALIZABLE", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The linearizability tests record the histories of concurrent clients of the server, and check that each history is
+// linearizable: every operation appears to take effect at a single point between its call and its response, in an
+// order that a sequential log could have produced the same responses in. The checker is the algorithm of Wing and
+// Gong with the memoization of Lowe: it searches the orders of the operations, linearizing at each step an operation
+// that was called before the earliest response among the operations left, and backtracks when none fits.
+
+// linOp is an operation of a history: a Produce, Consume or Fetch of a client, its request and response, and the
+// times it was called and returned at.
+type linOp struct {
+	client    int
+	kind      string
+	call, ret int64
+	// offset is the offset produced at, or consumed or fetched from.
+	offset uint64
+	// expected is the expected offset of a conditional Produce.
+	expected *uint64
+	// maxRecords is the maximum number of records of a Fetch.
+	maxRecords uint64
+	// values holds the value produced, or the values consumed or fetched.
+	values []string
+	// code is the status code of the response.
+	code codes.Code
+}
+
+func (op *linOp) String() string {
+	var request string
+	switch {
+	case op.kind == "produce" && op.expected != nil:
+		request = fmt.Sprintf("produce(%s, expected %d)", op.values[0], *op.expected)
+	case op.kind == "produce":
+		request = fmt.Sprintf("produce(%s)", op.values[0])
+	case op.kind == "consume":
+		request = fmt.Sprintf("consume(%d)", op.offset)
+	default:
+		request = fmt.Sprintf("fetch(%d, %d)", op.offset, op.maxRecords)
+	}
+	response := op.code.String()
+	if op.code == codes.OK {
+		if op.kind == "produce" {
+			response = fmt.Sprint(op.offset)
+		} else {
+			response = fmt.Sprint(op.values)
+		}
+	}
+	return fmt.Sprintf("client %d [%d, %d] %s = %s", op.client, op.call, op.ret, request, response)
+}
+
+// stepLog is the sequential specification of the log: it applies the operation to the values of the log, and reports
+// whether the operation could have had its response there.
+func stepLog(values []string, op *linOp) ([]string, bool) {
+	n := uint64(len(values))
+	switch op.kind {
+	case "produce":
+		if op.expected != nil && *op.expected != n {
+			return values, op.code == codes.Aborted
+		}
+		// a new slice, the state before is kept to backtrack to
+		return append(values[:n:n], op.values[0]), op.code == codes.OK && op.offset == n
+	case "consume":
+		if op.offset >= n {
+			return values, op.code == codes.OutOfRange
+		}
+		return values, op.code == codes.OK && op.values[0] == values[op.offset]
+	default:
+		if op.offset > n {
+			return values, op.code == codes.OutOfRange
+		}
+		want := values[op.offset:min(n, op.offset+op.maxRecords)]
+		return values, op.code == codes.OK && slices.Equal(op.values, want)
+	}
+}
+
+// linEntry is the call or the return of an operation, in the list of the events of a history ordered by time.
+type linEntry struct {
+	id int
+	op *linOp
+	// match is the return of a call, nil for a return.
+	match      *linEntry
+	prev, next *linEntry
+}
+
+// lift removes the call and its return from the list.
+func (e *linEntry) lift() {
+	e.prev.next = e.next
+	e.next.prev = e.prev
+	e.match.prev.next = e.match.next
+	if e.match.next != nil {
+		e.match.next.prev = e.match.prev
+	}
+}
+
+// unlift puts the call and its return back in the list.
+func (e *linEntry) unlift() {
+	e.match.prev.next = e.match
+	if e.match.next != nil {
+		e.match.next.prev = e.match
+	}
+	e.prev.next = e
+	e.next.prev = e
+}
+
+// linearizable reports whether the history is linearizable with respect to the sequential specification step, from
+// the initial state init. The states of a specification must not be modified by step, and are compared with equal.
+// Otherwise, it returns the longest linearization it found, to report where the history goes wrong.
+func linearizable[S any](history []*linOp, init S, step func(S, *linOp) (S, bool), equal func(S, S) bool) ([]*linOp, bool) {
+	// the list of calls and returns ordered by time, after a sentinel head
+	var events []*linEntry
+	for id, op := range history {
+		ret := &linEntry{id: id, op: op}
+		events = append(events, &linEntry{id: id, op: op, match: ret}, ret)
+	}
+	slices.SortFunc(events, func(a, b *linEntry) int {
+		return int(a.time() - b.time())
+	})
+	head := &linEntry{}
+	prev := head
+	for _, e := range events {
+		e.prev, prev.next = prev, e
+		prev = e
+	}
+
+	type call struct {
+		entry *linEntry
+		state S
+	}
+	var calls []call
+	var longest []*linOp
+	// the states reached by each set of linearized operations
+	linearized := make([]byte, (len(history)+7)/8)
+	cache := make(map[string][]S)
+
+	state := init
+	for e := head.next; head.next != nil; {
+		if e.match == nil {
+			// the earliest return, but its operation can't be linearized yet: backtrack
+			if len(calls) == 0 {
+				return longest, false
+			}
+			top := calls[len(calls)-1]
+			calls = calls[:len(calls)-1]
+			state = top.state
+			linearized[top.entry.id/8] &^= 1 << (top.entry.id % 8)
+			top.entry.unlift()
+			e = top.entry.next
+			continue
+		}
+
+		next, ok := step(state, e.op)
+		if ok {
+			linearized[e.id/8] |= 1 << (e.id % 8)
+			key := string(linearized)
+			seen := slices.ContainsFunc(cache[key], func(s S) bool { return equal(s, next) })
+			if !seen {
+				cache[key] = append(cache[key], next)
+				calls = append(calls, call{entry: e, state: state})
+				if len(calls) > len(longest) {
+					longest = longest[:0]
+					for _, c := range calls {
+						longest = append(longest, c.entry.op)
+					}
+				}
+				state = next
+				e.lift()
+				e = head.next
+				continue
+			}
+			linearized[e.id/8] &^= 1 << (e.id % 8)
+		}
+		e = e.next
+	}
+	return nil, true
+}
+
+// time is the time of the event.
+func (e *linEntry) time() int64 {
+	if e.match != nil {
+		return e.op.call
+	}
+	return e.op.ret
+}
+
+// recordHistory runs clients concurrently against the server, each running ops operations on a log holding start
+// records, and returns the history of their operations. Times are taken from a counter shared by the clients, so that
+// they are totally ordered.
+func recordHistory(t *testing.T, client api.LogClient, clients, ops int, seed int64, start uint64) []*linOp {
+	var clock atomic.Int64
+	// produced is the offset following the highest offset produced at, for the clients to read around
+	var produced atomic.Uint64
+	produced.Store(start)
+	histories := make([][]*linOp, clients)
+
+	var wg sync.WaitGroup
+	for c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed*1000 + int64(c)))
+			ctx := context.Background()
+			for i := range ops {
+				op := &linOp{client: c}
+				switch k := r.Intn(100); {
+				case k < 50:
+					op.kind = "produce"
+					op.values = []string{fmt.Sprintf("%d-%d-%d", seed, c, i)}
+					req := &api.ProduceRequest{Record: &api.Record{Value: []byte(op.values[0])}}
+					if k < 15 {
+						expected := produced.Load()
+						op.expected, req.ExpectedOffset = &expected, &expected
+					}
+					op.call = clock.Add(1)
+					res, err := client.Produce(ctx, req)
+					op.ret = clock.Add(1)
+					op.code = status.Code(err)
+					if err == nil {
+						op.offset = res.Offset
+						for next := produced.Load(); next <= res.Offset; next = produced.Load() {
+							if produced.CompareAndSwap(next, res.Offset+1) {
+								break
+							}
+						}
+					}
+				case k < 85:
+					op.kind = "consume"
+					op.offset = pickOffset(r, produced.Load())
+					op.call = clock.Add(1)
+					res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: op.offset})
+					op.ret = clock.Add(1)
+					op.code = status.Code(err)
+					if err == nil {
+						op.values = []string{string(res.Record.Value)}
+					}
+				default:
+					op.kind = "fetch"
+					op.offset = pickOffset(r, produced.Load())
+					op.maxRecords = uint64(1 + r.Intn(8))
+					op.call = clock.Add(1)
+					res, err := client.Fetch(ctx, &api.FetchRequest{Offset: op.offset, MaxRecords: uint32(op.maxRecords)})
+					op.ret = clock.Add(1)
+					op.code = status.Code(err)
+					for _, record := range res.GetRecords() {
+						op.values = append(op.values, string(record.Value))
+					}
+				}
+				// any other response leaves the outcome of the operation unknown
+				assert.Contains(t, []codes.Code{codes.OK, codes.OutOfRange, codes.Aborted}, op.code, "%s", op)
+				histories[c] = append(histories[c], op)
+			}
+		}()
+	}
+	wg.Wait()
+	return slices.Concat(histories...)
+}
+
+// pickOffset returns an offset to read, given the offset following the highest one produced at: mostly around the end
+// of the log, where reads race with produces, otherwise anywhere in it.
+func pickOffset(r *rand.Rand, produced uint64) uint64 {
+	if r.Intn(4) == 0 {
+		return uint64(r.Int63n(int64(produced) + 1))
+	}
+	return max(produced+2, 4) - uint64(r.Intn(5))
+}
+
+func TestLinearizable(t *testing.T) {
+	produce := func(call, ret int64, value string, offset uint64) *linOp {
+		return &linOp{kind: "produce", call: call, ret: ret, values: []string{value}, offset: offset}
+	}
+	consume := func(call, ret int64, offset uint64, value string) *linOp {
+		op := &linOp{kind: "consume", call: call, ret: ret, offset: offset, values: []string{value}}
+		if value == "" {
+			op.code = codes.OutOfRange
+		}
+		return op
+	}
+
+	for _, tc := range []struct {
+		name         string
+		history      []*linOp
+		linearizable bool
+	}{
+		{
+			name:         "sequential",
+			history:      []*linOp{produce(1, 2, "a", 0), consume(3, 4, 0, "a"), consume(5, 6, 1, "")},
+			linearizable: true,
+		},
+		{
+			name:         "concurrent produces",
+			history:      []*linOp{produce(1, 4, "a", 1), produce(2, 3, "b", 0)},
+			linearizable: true,
+		},
+		{
+			name:         "read during produce",
+			history:      []*linOp{produce(1, 6, "a", 0), consume(2, 3, 0, "a"), consume(4, 5, 0, "")},
+			linearizable: false,
+		},
+		{
+			name:         "concurrent reads during produce",
+			history:      []*linOp{produce(1, 6, "a", 0), consume(2, 4, 0, "a"), consume(3, 5, 0, "")},
+			linearizable: true,
+		},
+		{
+			name:         "stale read",
+			history:      []*linOp{produce(1, 2, "a", 0), consume(3, 4, 0, "")},
+			linearizable: false,
+		},
+		{
+			name:         "read before produce",
+			history:      []*linOp{consume(1, 2, 0, "a"), produce(3, 4, "a", 0)},
+			linearizable: false,
+		},
+		{
+			name:         "offsets out of order",
+			history:      []*linOp{produce(1, 2, "a", 1), produce(3, 4, "b", 0)},
+			linearizable: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ok := linearizable(tc.history, []string(nil), stepLog, slices.Equal[[]string])
+			require.Equal(t, tc.linearizable, ok)
+		})
+	}
+}
+
+func TestGRPCLinearizability(t *testing.T) {
+	for _, tc := range []struct {
+		clients int
+		// maxStoreBytes is the size of the segments of the segmented log, 0 for the in-memory log
+		maxStoreBytes uint64
+	}{
+		{clients: 2},
+		{clients: 8},
+		{clients: 2, maxStoreBytes: 64},
+		{clients: 8, maxStoreBytes: 64},
+		{clients: 4, maxStoreBytes: 256},
+		{clients: 16, maxStoreBytes: 256},
+		{clients: 16, maxStoreBytes: 64 * 1024},
+	} {
+		name := fmt.Sprintf("memory/%d clients", tc.clients)
+		if tc.maxStoreBytes > 0 {
+			name = fmt.Sprintf("segmented %d bytes/%d clients", tc.maxStoreBytes, tc.clients)
+		}
+		t.Run(name, func(t *testing.T) {
+			var commitLog CommitLog = NewLog()
+			if tc.maxStoreBytes > 0 {
+				l, err := log.NewLog(t.TempDir(), *log.NewConfig().WithSegmentMaxStoreBytes(tc.maxStoreBytes))
+				require.NoError(t, err)
+				t.Cleanup(func() { _ = l.Close() })
+				commitLog = l
+			}
+			client := setupGRPC(t, commitLog)
+
+			for seed := range int64(3) {
+				// the log keeps growing across the histories, each starts from the records of the previous ones
+				init, err := readAll(client)
+				require.NoError(t, err)
+				history := recordHistory(t, client, tc.clients, 400/tc.clients, seed, uint64(len(init)))
+				if longest, ok := linearizable(history, init, stepLog, slices.Equal[[]string]); !ok {
+					lines := make([]string, len(longest))
+					for i, op := range longest {
+						lines[i] = op.String()
+					}
+					slices.SortFunc(history, func(a, b *linOp) int { return int(a.call - b.call) })
+					t.Fatalf("history of seed %d is not linearizable, linearized %d of %d operations:\n%s\nhistory:\n%s",
+						seed, len(longest), len(history), strings.Join(lines, "\n"), formatHistory(history))
+				}
+			}
+		})
+	}
+}
+
+// readAll reads the values of all records of the log.
+func readAll(client api.LogClient) ([]string, error) {
+	var values []string
+	for offset := uint64(0); ; {
+		res, err := client.Fetch(context.Background(), &api.FetchRequest{Offset: offset})
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Records) == 0 {
+			return values, nil
+		}
+		for _, record := range res.Records {
+			values = append(values, string(record.Value))
+		}
+		offset = res.NextOffset
+	}
+}
+
+// formatHistory returns the operations of the history, one per line.
+func formatHistory(history []*linOp) string {
+	lines := make([]string, len(history))
+	for i, op := range history {
+		lines[i] = op.String()
+	}
+	return strings.Join(lines, "\n")
+}
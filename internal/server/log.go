@@ -1,41 +1,247 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"sync"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// defaultMaxRecordBytes is the maximum size of an encoded record, the default of the commit log.
+	defaultMaxRecordBytes = 4 << 20
+	// defaultFetchMaxRecords is the number of records fetched at once unless the client asks for fewer.
+	defaultFetchMaxRecords = 1000
+	// defaultFetchMaxBytes is the size of the records fetched at once unless the client asks for less.
+	defaultFetchMaxBytes = 1 << 20
+)
+
+// CommitLog is the log served by the HTTP and gRPC servers. It is implemented by the segmented log.Log, and by the
+// in-memory Log. Both report reads beyond the log with log.ErrOffsetOutOfRange, records above their size limit with
+// log.ErrRecordTooLarge, failed conditional appends with a *log.OffsetConflictError, and stale sequence numbers of
+// idempotent producers with log.ErrStaleSequence.
+type CommitLog interface {
+	// AppendContext appends the record and returns its offset.
+	AppendContext(ctx context.Context, record *api.Record) (uint64, error)
+	// AppendIfNextOffsetContext appends the record only if it gets the expected offset.
+	AppendIfNextOffsetContext(ctx context.Context, expected uint64, record *api.Record) (uint64, error)
+	// ReadContext returns the record at the offset.
+	ReadContext(ctx context.Context, offset uint64) (*api.Record, error)
+	// ReadRange returns the contiguous records from the given offset on within the limits, and the offset following
+	// them.
+	ReadRange(from, maxRecords, maxBytes uint64) ([]*api.Record, uint64, error)
+	// LowestOffset returns the offset of the first record of the log.
+	LowestOffset() (uint64, error)
+	// HighestOffset returns the offset of the last record of the log.
+	HighestOffset() (uint64, error)
+	// StableOffset returns the offset read-committed consumers read up to.
+	StableOffset() uint64
+	// Aborted reports whether the record belongs to an aborted transaction.
+	Aborted(record *api.Record) bool
+}
+
+var (
+	_ CommitLog = (*Log)(nil)
+	_ CommitLog = (*log.Log)(nil)
 )
 
-// Record represents a single log record with its value and offset.
-type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+// errHidden is returned when reading a record that the consumer does not see at its isolation level.
+var errHidden = fmt.Errorf("record hidden at the isolation level")
+
+// visible reports whether a consumer at the isolation level sees the record: transaction markers are never seen, and
+// read-committed consumers only see the records below the last stable offset that were not aborted.
+func visible(l CommitLog, record *api.Record, level api.IsolationLevel) bool {
+	if record.Control != api.Control_CONTROL_NONE {
+		return false
+	}
+	return level != api.IsolationLevel_READ_COMMITTED || record.Offset < l.StableOffset() && !l.Aborted(record)
+}
+
+// readVisible reads the record at the offset, failing with errHidden if a consumer at the isolation level does not
+// see it.
+func readVisible(ctx context.Context, l CommitLog, offset uint64, level api.IsolationLevel) (*api.Record, error) {
+	record, err := l.ReadContext(ctx, offset)
+	if err != nil {
+		return nil, err
+	}
+	if !visible(l, record, level) {
+		return nil, fmt.Errorf("%w: offset %d", errHidden, offset)
+	}
+	return record, nil
+}
+
+// fetch is like CommitLog.ReadRange, but returns only the records a consumer at the isolation level sees: reads stop
+// at the last stable offset for read-committed consumers, and the other records are skipped. The limits apply to the
+// records read, skipped ones included, and the returned offset follows them as well.
+func fetch(l CommitLog, from, maxRecords, maxBytes uint64, level api.IsolationLevel) ([]*api.Record, uint64, error) {
+	if level == api.IsolationLevel_READ_COMMITTED {
+		stable := l.StableOffset()
+		if from >= stable {
+			return nil, from, nil
+		}
+		if maxRecords == 0 || maxRecords > stable-from {
+			maxRecords = stable - from
+		}
+	}
+	records, next, err := l.ReadRange(from, maxRecords, maxBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	seen := records[:0]
+	for _, record := range records {
+		if visible(l, record, level) {
+			seen = append(seen, record)
+		}
+	}
+	return seen, next, nil
 }
 
-// Log is an in-memory append-only log structure.
+// Log is an in-memory append-only log structure. It has no transactions.
 type Log struct {
 	mu      sync.Mutex
-	records []Record
+	records []*api.Record
+	// maxRecordBytes is the maximum size of an encoded record, like the commit log's.
+	maxRecordBytes int
+	// producers holds the last record appended by each idempotent producer, by producer id.
+	producers map[uint64]*api.Record
 }
 
 func NewLog() *Log {
-	return &Log{}
+	return &Log{
+		maxRecordBytes: defaultMaxRecordBytes,
+		producers:      make(map[uint64]*api.Record),
+	}
+}
+
+// Append adds the record to the log and returns its offset. Records larger than the maximum record size are rejected
+// with log.ErrRecordTooLarge, and records of idempotent producers are deduplicated, like the commit log does.
+func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.append(record, nil)
 }
 
-func (l *Log) Append(record Record) (uint64, error) {
+// AppendIfNextOffset appends the record only if it gets the expected offset, and fails with a
+// *log.OffsetConflictError otherwise, like the commit log does.
+func (l *Log) AppendIfNextOffset(expected uint64, record *api.Record) (uint64, error) {
+	return l.append(record, &expected)
+}
+
+// append appends the record, if the log ends at the expected offset unless expected is nil.
+func (l *Log) append(record *api.Record, expected *uint64) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	record.Offset = uint64(len(l.records))
-	l.records = append(l.records, record)
-	return record.Offset, nil
+	if last, ok := l.producers[record.ProducerId]; ok && record.ProducerId != 0 {
+		if record.Sequence == last.Sequence {
+			return last.Offset, nil
+		}
+		if record.Sequence < last.Sequence {
+			return 0, fmt.Errorf("%w: producer %d sent sequence %d after %d",
+				log.ErrStaleSequence, record.ProducerId, record.Sequence, last.Sequence)
+		}
+	}
+	next := uint64(len(l.records))
+	if expected != nil && *expected != next {
+		return 0, &log.OffsetConflictError{Expected: *expected, Actual: next}
+	}
+	// the log keeps its own copy, the caller may reuse the record
+	stored := proto.Clone(record).(*api.Record)
+	// the size includes the offset, like the commit log's
+	stored.Offset = next
+	if n := proto.Size(stored); n > l.maxRecordBytes {
+		return 0, fmt.Errorf("%w: %d bytes", log.ErrRecordTooLarge, n)
+	}
+	l.records = append(l.records, stored)
+	if stored.ProducerId != 0 {
+		l.producers[stored.ProducerId] = stored
+	}
+	// the caller's record only gets its offset once it is appended
+	record.Offset = next
+	return next, nil
 }
 
-func (l *Log) Read(offset uint64) (Record, error) {
+// AppendContext is like Append, but fails with the context's error if the context is done.
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return l.Append(record)
+}
+
+// AppendIfNextOffsetContext is like AppendIfNextOffset, but fails with the context's error if the context is done.
+func (l *Log) AppendIfNextOffsetContext(ctx context.Context, expected uint64, record *api.Record) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return l.AppendIfNextOffset(expected, record)
+}
+
+// Read returns a copy of the record at the offset, or log.ErrOffsetOutOfRange if there is none.
+func (l *Log) Read(offset uint64) (*api.Record, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	if offset >= uint64(len(l.records)) {
-		return Record{}, ErrOffsetNotFound
+		return nil, log.ErrOffsetOutOfRange
+	}
+	return proto.Clone(l.records[offset]).(*api.Record), nil
+}
+
+// ReadContext is like Read, but fails with the context's error if the context is done.
+func (l *Log) ReadContext(ctx context.Context, offset uint64) (*api.Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return l.records[offset], nil
+	return l.Read(offset)
 }
 
-var ErrOffsetNotFound = fmt.Errorf("offset not found")
+// ReadRange returns the contiguous records from the given offset on, up to maxRecords records and maxBytes bytes of
+// encoded records (0 means no limit), and the offset to read from next. The first record is returned even if it
+// exceeds maxBytes. At the end of the log, it returns no records and the given offset.
+func (l *Log) ReadRange(from, maxRecords, maxBytes uint64) ([]*api.Record, uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if from > uint64(len(l.records)) {
+		return nil, from, log.ErrOffsetOutOfRange
+	}
+
+	var records []*api.Record
+	var size uint64
+	for _, record := range l.records[from:] {
+		n := uint64(proto.Size(record))
+		if maxRecords > 0 && uint64(len(records)) >= maxRecords ||
+			maxBytes > 0 && len(records) > 0 && size+n > maxBytes {
+			break
+		}
+		records = append(records, proto.Clone(record).(*api.Record))
+		size += n
+	}
+	return records, from + uint64(len(records)), nil
+}
+
+// LowestOffset returns the offset of the first record, which is always 0.
+func (l *Log) LowestOffset() (uint64, error) {
+	return 0, nil
+}
+
+// HighestOffset returns the offset of the last record, or log.ErrOffsetOutOfRange if the log is empty.
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.records) == 0 {
+		return 0, log.ErrOffsetOutOfRange
+	}
+	return uint64(len(l.records)) - 1, nil
+}
+
+// StableOffset returns the end of the log, as there are no transactions.
+func (l *Log) StableOffset() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(len(l.records))
+}
+
+// Aborted reports false, as there are no transactions.
+func (l *Log) Aborted(*api.Record) bool {
+	return false
+}
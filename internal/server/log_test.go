@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	"github.com/Devin-Yeung/proglog/internal/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backend opens a commit log for the tests, rejecting records larger than maxRecordBytes (0 keeps the default).
+type backend struct {
+	name string
+	open func(t *testing.T, maxRecordBytes uint64) CommitLog
+}
+
+// backends are the implementations of CommitLog every server test runs against.
+var backends = []backend{
+	{
+		name: "memory",
+		open: func(t *testing.T, maxRecordBytes uint64) CommitLog {
+			l := NewLog()
+			if maxRecordBytes > 0 {
+				l.maxRecordBytes = int(maxRecordBytes)
+			}
+			return l
+		},
+	},
+	{
+		name: "segmented",
+		open: func(t *testing.T, maxRecordBytes uint64) CommitLog {
+			// tiny segments, so that the tests cover rolls
+			config := log.NewConfig().WithSegmentMaxStoreBytes(128).WithMaxRecordBytes(maxRecordBytes)
+			l, err := log.NewLog(t.TempDir(), *config)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = l.Close() })
+			return l
+		},
+	},
+}
+
+// forEachBackend runs the test against every backend.
+func forEachBackend(t *testing.T, fn func(t *testing.T, b backend)) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			fn(t, b)
+		})
+	}
+}
+
+// TestCommitLog is the conformance suite of CommitLog: every implementation must behave the same.
+func TestCommitLog(t *testing.T) {
+	for name, fn := range map[string]func(t *testing.T, l CommitLog){
+		"append/read":      testAppendRead,
+		"offsets":          testOffsets,
+		"conditional":      testConditionalAppend,
+		"idempotent":       testIdempotentAppend,
+		"read range":       testReadRange,
+		"record too large": testRecordTooLarge,
+		"canceled":         testCanceled,
+	} {
+		t.Run(name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, b backend) {
+				fn(t, b.open(t, 64))
+			})
+		})
+	}
+}
+
+func testAppendRead(t *testing.T, l CommitLog) {
+	ctx := context.Background()
+	for i := uint64(0); i < 20; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		offset, err := l.AppendContext(ctx, record)
+		require.NoError(t, err)
+		require.Equal(t, i, offset)
+		require.Equal(t, i, record.Offset)
+		// the log does not keep the caller's record
+		record.Value[0] = 'R'
+	}
+
+	for i := uint64(0); i < 20; i++ {
+		record, err := l.ReadContext(ctx, i)
+		require.NoError(t, err)
+		assert.Equal(t, i, record.Offset)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	_, err := l.ReadContext(ctx, 20)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+}
+
+func testOffsets(t *testing.T, l CommitLog) {
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	_, err = l.HighestOffset()
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+	require.Equal(t, uint64(0), l.StableOffset())
+
+	for range 10 {
+		_, err = l.AppendContext(context.Background(), &api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+	highest, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), highest)
+	require.Equal(t, uint64(10), l.StableOffset())
+	require.False(t, l.Aborted(&api.Record{Offset: 3}))
+}
+
+func testConditionalAppend(t *testing.T, l CommitLog) {
+	ctx := context.Background()
+	offset, err := l.AppendIfNextOffsetContext(ctx, 0, &api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), offset)
+
+	rejected := &api.Record{Value: []byte("conflict")}
+	_, err = l.AppendIfNextOffsetContext(ctx, 0, rejected)
+	var conflict *log.OffsetConflictError
+	require.ErrorAs(t, err, &conflict)
+	require.Equal(t, uint64(1), conflict.Actual)
+	require.ErrorIs(t, err, log.ErrOffsetConflict)
+	require.Equal(t, uint64(0), rejected.Offset)
+
+	_, err = l.ReadContext(ctx, 1)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+}
+
+func testIdempotentAppend(t *testing.T, l CommitLog) {
+	ctx := context.Background()
+	produce := func(sequence uint64) (uint64, error) {
+		return l.AppendContext(ctx, &api.Record{Value: []byte("value"), ProducerId: 7, Sequence: sequence})
+	}
+
+	first, err := produce(3)
+	require.NoError(t, err)
+	retried, err := produce(3)
+	require.NoError(t, err)
+	require.Equal(t, first, retried)
+	next, err := produce(5)
+	require.NoError(t, err)
+	require.Equal(t, first+1, next)
+	_, err = produce(4)
+	require.ErrorIs(t, err, log.ErrStaleSequence)
+
+	record, err := l.ReadContext(ctx, next)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), record.ProducerId)
+	require.Equal(t, uint64(5), record.Sequence)
+}
+
+func testReadRange(t *testing.T, l CommitLog) {
+	for i := range 10 {
+		_, err := l.AppendContext(context.Background(), &api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	records, next, err := l.ReadRange(2, 5, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 5)
+	for i, record := range records {
+		assert.Equal(t, uint64(i+2), record.Offset)
+	}
+	require.Equal(t, uint64(7), next)
+
+	// the first record is returned even if it exceeds the byte limit
+	records, next, err = l.ReadRange(7, 0, 1)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, uint64(8), next)
+
+	records, next, err = l.ReadRange(8, 0, 0)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(10), next)
+
+	records, next, err = l.ReadRange(10, 0, 0)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	require.Equal(t, uint64(10), next)
+
+	_, _, err = l.ReadRange(11, 0, 0)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+}
+
+func testRecordTooLarge(t *testing.T, l CommitLog) {
+	ctx := context.Background()
+	_, err := l.AppendContext(ctx, &api.Record{Value: make([]byte, 32)})
+	require.NoError(t, err)
+	rejected := &api.Record{Value: make([]byte, 64)}
+	_, err = l.AppendContext(ctx, rejected)
+	require.ErrorIs(t, err, log.ErrRecordTooLarge)
+	// a rejected record gets no offset
+	require.Equal(t, uint64(0), rejected.Offset)
+	_, err = l.ReadContext(ctx, 1)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+}
+
+func testCanceled(t *testing.T, l CommitLog) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := l.AppendContext(ctx, &api.Record{Value: []byte("canceled")})
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = l.ReadContext(ctx, 0)
+	require.ErrorIs(t, err, context.Canceled)
+	_, err = l.ReadContext(context.Background(), 0)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+}
@@ -0,0 +1,26 @@
+// Package log embeds the segmented, append-only log of proglog in a Go program.
+//
+// A Log is a directory of segments holding records, each identified by its offset in the log:
+//
+//	l, err := log.Open(dir, log.WithSegmentMaxBytes(64<<20))
+//	if err != nil {
+//		return err
+//	}
+//	defer l.Close()
+//
+//	offset, err := l.Append(ctx, []byte("hello"))
+//	...
+//	for record, err := range l.Records(ctx, offset) {
+//		...
+//	}
+//
+// # Compatibility
+//
+// The package follows the semantic versioning of the module. Within a major version, exported identifiers are neither
+// removed nor changed in an incompatible way, and the errors documented by a function keep matching with errors.Is.
+// Minor versions may add options, methods and fields to Record. Logs written by a version are readable by every later
+// version of the same major version.
+//
+// The storage internals (the store, index and segment files, and the manifest) are not part of the API: their layout
+// may change in any version, as long as existing logs stay readable.
+package log
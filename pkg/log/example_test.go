@@ -0,0 +1,40 @@
+package log_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/Devin-Yeung/proglog/pkg/log"
+)
+
+func Example() {
+	dir, err := os.MkdirTemp("", "log")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := log.Open(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	ctx := context.Background()
+	for _, value := range []string{"first", "second", "third"} {
+		if _, err := l.Append(ctx, []byte(value)); err != nil {
+			panic(err)
+		}
+	}
+
+	for record, err := range l.Records(ctx, 1) {
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(record.Offset, string(record.Value))
+	}
+	// Output:
+	// 1 second
+	// 2 third
+}
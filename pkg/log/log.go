@@ -0,0 +1,125 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"iter"
+
+	api "github.com/Devin-Yeung/proglog/api/v1"
+	seglog "github.com/Devin-Yeung/proglog/internal/log"
+)
+
+// iterateBatchBytes is the size of the records read at once while iterating.
+const iterateBatchBytes = 1 << 20
+
+var (
+	// ErrOffsetOutOfRange is returned when reading an offset beyond the end of the log, or below its lowest offset.
+	ErrOffsetOutOfRange = seglog.ErrOffsetOutOfRange
+	// ErrRecordTooLarge is returned when appending or reading a record larger than the maximum record size.
+	ErrRecordTooLarge = seglog.ErrRecordTooLarge
+	// ErrSegmentActive is returned when truncating records of the segment being appended to.
+	ErrSegmentActive = seglog.ErrSegmentActive
+	// ErrReadOnly is returned when appending to or truncating a log opened with WithReadOnly.
+	ErrReadOnly = seglog.ErrReadOnly
+	// ErrLogLocked is returned when opening a log for writing while another Log or process has it open for writing.
+	ErrLogLocked = seglog.ErrLogLocked
+)
+
+// Record is a record of the log.
+type Record struct {
+	// Offset is the position of the record in the log.
+	Offset uint64
+	// Value is the data appended.
+	Value []byte
+}
+
+// Log is a segmented, append-only log of records stored in a directory. It is safe for concurrent use: appends and
+// truncations are serialized, reads run concurrently with them.
+type Log struct {
+	log *seglog.Log
+}
+
+// Open opens the log in the given directory, creating it if it is empty. Unless opened with WithReadOnly, the
+// directory is locked until the log is closed.
+func Open(dir string, opts ...Option) (*Log, error) {
+	config := seglog.NewConfig()
+	for _, opt := range opts {
+		opt.apply(config)
+	}
+	l, err := seglog.NewLog(dir, *config)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{log: l}, nil
+}
+
+// Append appends the value to the log and returns its offset. The log keeps a copy of the value. It fails with the
+// context's error if the context is done before the record is appended.
+func (l *Log) Append(ctx context.Context, value []byte) (uint64, error) {
+	return l.log.AppendContext(ctx, &api.Record{Value: value})
+}
+
+// Read returns the record at the offset, or ErrOffsetOutOfRange if the log holds none.
+func (l *Log) Read(ctx context.Context, offset uint64) (Record, error) {
+	record, err := l.log.ReadContext(ctx, offset)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Offset: record.Offset, Value: record.Value}, nil
+}
+
+// Records iterates over the records from the given offset to the end of the log. Records appended during the
+// iteration are included. An error ends the iteration, like ErrOffsetOutOfRange if the given offset is beyond the end
+// of the log, or was truncated before the iteration reached it.
+func (l *Log) Records(ctx context.Context, from uint64) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(Record{}, err)
+				return
+			}
+			records, next, err := l.log.ReadRange(from, 0, iterateBatchBytes)
+			if err != nil {
+				yield(Record{}, err)
+				return
+			}
+			if len(records) == 0 {
+				return
+			}
+			for _, record := range records {
+				if !yield(Record{Offset: record.Offset, Value: record.Value}, nil) {
+					return
+				}
+			}
+			from = next
+		}
+	}
+}
+
+// Truncate removes the records below the given offset. Records are removed a segment at a time, so records below the
+// offset are kept if their segment holds records at or beyond it. The segment being appended to is never removed:
+// truncating its records fails with ErrSegmentActive.
+func (l *Log) Truncate(ctx context.Context, lowest uint64) error {
+	return l.log.TruncateContext(ctx, lowest)
+}
+
+// LowestOffset returns the offset of the first record of the log.
+func (l *Log) LowestOffset() uint64 {
+	lowest, _ := l.log.LowestOffset()
+	return lowest
+}
+
+// NextOffset returns the offset the next record appended gets, the end of the log.
+func (l *Log) NextOffset() uint64 {
+	highest, err := l.log.HighestOffset()
+	if errors.Is(err, seglog.ErrOffsetOutOfRange) {
+		return l.LowestOffset()
+	}
+	return highest + 1
+}
+
+// Close closes the log, releasing the lock of the directory. Reads in progress complete, but the log must not be
+// used afterwards.
+func (l *Log) Close() error {
+	return l.log.Close()
+}
@@ -0,0 +1,143 @@
+package log_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Devin-Yeung/proglog/pkg/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := log.Open(dir, log.WithSegmentMaxBytes(256), log.WithInitialOffset(10))
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), l.LowestOffset())
+	require.Equal(t, uint64(10), l.NextOffset())
+
+	for i := range 50 {
+		offset, err := l.Append(ctx, []byte(fmt.Sprintf("record %d", i)))
+		require.NoError(t, err)
+		require.Equal(t, uint64(10+i), offset)
+	}
+	require.Equal(t, uint64(60), l.NextOffset())
+
+	record, err := l.Read(ctx, 12)
+	require.NoError(t, err)
+	require.Equal(t, log.Record{Offset: 12, Value: []byte("record 2")}, record)
+	_, err = l.Read(ctx, 60)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+
+	// the log is still there once opened again
+	require.NoError(t, l.Close())
+	l, err = log.Open(dir, log.WithSegmentMaxBytes(256))
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Truncate(ctx, 40))
+	lowest := l.LowestOffset()
+	require.LessOrEqual(t, lowest, uint64(40))
+	require.Greater(t, lowest, uint64(10))
+	_, err = l.Read(ctx, lowest-1)
+	require.ErrorIs(t, err, log.ErrOffsetOutOfRange)
+	require.ErrorIs(t, l.Truncate(ctx, 60), log.ErrSegmentActive)
+
+	var offsets []uint64
+	for record, err := range l.Records(ctx, lowest) {
+		require.NoError(t, err)
+		assert.Equal(t, []byte(fmt.Sprintf("record %d", record.Offset-10)), record.Value)
+		offsets = append(offsets, record.Offset)
+	}
+	require.Len(t, offsets, int(60-lowest))
+	require.Equal(t, lowest, offsets[0])
+	require.Equal(t, uint64(59), offsets[len(offsets)-1])
+}
+
+func TestLogRecords(t *testing.T) {
+	ctx := context.Background()
+	l, err := log.Open(t.TempDir())
+	require.NoError(t, err)
+	defer l.Close()
+	for i := range 5 {
+		_, err := l.Append(ctx, []byte(fmt.Sprintf("record %d", i)))
+		require.NoError(t, err)
+	}
+
+	// breaking out of the loop stops the iteration
+	var n int
+	for _, err := range l.Records(ctx, 0) {
+		require.NoError(t, err)
+		if n++; n == 2 {
+			break
+		}
+	}
+	require.Equal(t, 2, n)
+
+	// the end of the log yields nothing
+	for range l.Records(ctx, 5) {
+		t.Fatal("record beyond the end of the log")
+	}
+
+	var errs []error
+	for _, err := range l.Records(ctx, 6) {
+		errs = append(errs, err)
+	}
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[0], log.ErrOffsetOutOfRange)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	errs = errs[:0]
+	for _, err := range l.Records(canceled, 0) {
+		errs = append(errs, err)
+	}
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[0], context.Canceled)
+}
+
+func TestLogOptions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := log.Open(dir, log.WithMaxRecordBytes(32))
+	require.NoError(t, err)
+
+	_, err = l.Append(ctx, make([]byte, 64))
+	require.ErrorIs(t, err, log.ErrRecordTooLarge)
+	_, err = log.Open(dir)
+	require.ErrorIs(t, err, log.ErrLogLocked)
+
+	_, err = l.Append(ctx, []byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	readOnly, err := log.Open(dir, log.WithReadOnly())
+	require.NoError(t, err)
+	defer readOnly.Close()
+	record, err := readOnly.Read(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), record.Value)
+	_, err = readOnly.Append(ctx, []byte("hello"))
+	require.ErrorIs(t, err, log.ErrReadOnly)
+}
+
+func TestLogInMemory(t *testing.T) {
+	ctx := context.Background()
+	l, err := log.Open("memory", log.WithInMemory(), log.WithSegmentMaxBytes(64))
+	require.NoError(t, err)
+	defer l.Close()
+
+	for i := range 10 {
+		offset, err := l.Append(ctx, []byte(fmt.Sprintf("record %d", i)))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), offset)
+	}
+	record, err := l.Read(ctx, 9)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 9"), record.Value)
+	_, err = os.Stat("memory")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,59 @@
+package log
+
+import (
+	"time"
+
+	seglog "github.com/Devin-Yeung/proglog/internal/log"
+)
+
+// Option configures a Log when it is opened.
+type Option struct {
+	apply func(c *seglog.Config)
+}
+
+// WithSegmentMaxBytes rolls a new segment once the records of the current one take the given number of bytes. Old
+// records are truncated a segment at a time, so smaller segments make truncation finer. The default is 1 MiB.
+func WithSegmentMaxBytes(bytes uint64) Option {
+	return Option{func(c *seglog.Config) { c.WithSegmentMaxStoreBytes(bytes) }}
+}
+
+// WithSegmentMaxAge rolls a new segment once the current one is older than the given age, so that a log with little
+// traffic can still be truncated. By default, segments are only rolled when full.
+func WithSegmentMaxAge(age time.Duration) Option {
+	return Option{func(c *seglog.Config) { c.WithSegmentMaxAge(age) }}
+}
+
+// WithIndexIntervalBytes indexes a record only once the given number of bytes were appended since the previous indexed
+// record, trading slower reads for smaller indexes. By default, every record is indexed.
+func WithIndexIntervalBytes(bytes uint64) Option {
+	return Option{func(c *seglog.Config) { c.WithSegmentIndexIntervalBytes(bytes) }}
+}
+
+// WithInitialOffset sets the offset of the first record of a new log. It has no effect on an existing log.
+func WithInitialOffset(offset uint64) Option {
+	return Option{func(c *seglog.Config) { c.WithSegmentInitialOffset(offset) }}
+}
+
+// WithMaxRecordBytes limits the size of a record, including a few bytes of framing. Appending a larger record fails
+// with ErrRecordTooLarge, and so does reading one written with a higher limit. The default is 4 MiB.
+func WithMaxRecordBytes(bytes uint64) Option {
+	return Option{func(c *seglog.Config) { c.WithMaxRecordBytes(bytes) }}
+}
+
+// WithMaxOpenSegments limits the number of old segments whose files are kept open, each taking two file descriptors
+// and memory mappings. The default is 128.
+func WithMaxOpenSegments(n int) Option {
+	return Option{func(c *seglog.Config) { c.WithMaxOpenSegments(n) }}
+}
+
+// WithReadOnly opens the log for reading only, so that it can be read while another process appends to it. It sees
+// the records that were written when it was opened, and appending or truncating fails with ErrReadOnly.
+func WithReadOnly() Option {
+	return Option{func(c *seglog.Config) { c.WithReadOnly() }}
+}
+
+// WithInMemory keeps the log in memory rather than in the directory, for tests and short-lived pipelines that need no
+// durability. Segments are rolled and truncated as on disk, and the records are lost when the log is closed.
+func WithInMemory() Option {
+	return Option{func(c *seglog.Config) { c.WithInMemory() }}
+}